@@ -24,6 +24,8 @@ var (
 	vhdFlag      bool
 	readOnlyFlag bool
 
+	releaseLeaseFlag bool
+
 	autoCreate bool
 
 	mountCmd = &cobra.Command{
@@ -93,7 +95,12 @@ dyskctl unmount --deviceName dysk01`,
 		Run: func(cmd *cobra.Command, args []string) {
 			validateOutput()
 			dyskClient := client.CreateClient("", "")
-			err := dyskClient.Unmount(deviceName)
+			var err error
+			if releaseLeaseFlag {
+				err = dyskClient.UnmountAndReleaseLease(deviceName)
+			} else {
+				err = dyskClient.Unmount(deviceName)
+			}
 			if nil != err {
 				printError(err)
 				os.Exit(1)
@@ -158,6 +165,7 @@ func init() {
 
 	// UNMOUNT //
 	unmountCmd.PersistentFlags().StringVarP(&deviceName, "device-name", "d", "", "block device name")
+	unmountCmd.PersistentFlags().BoolVarP(&releaseLeaseFlag, "release-lease", "l", false, "release the lease on the page blob after unmount")
 
 	// GET //
 	getCmd.PersistentFlags().StringVarP(&deviceName, "device-name", "d", "", "block device name")
@@ -44,7 +44,7 @@ func mount() {
 	}
 	d.Name = deviceName
 	d.SizeGB = int(size)
-	d.Path = "/" + container + "/" + pageBlobName
+	d.SetBlob(container, pageBlobName)
 	d.LeaseId = leaseId
 	d.Vhd = vhdFlag
 
@@ -58,7 +58,7 @@ func mount() {
 }
 
 func getRandomDyskName() string {
-	var of = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	var of = []rune("0123456789abcdefghijklmnopqrstuvwxyz")
 	out := make([]rune, 8)
 	for i := range out {
 		out[i] = of[rand.Intn(len(of))]
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// The subset of the blob service used by the client. sdkBlobService wraps the
+// Azure SDK, tests can inject a fake with withBlobBackend
+type blobBackend interface {
+	GetContainerReference(name string) blobContainer
+}
+
+type blobContainer interface {
+	Exists() (bool, error)
+	CreateIfNotExists(options *storage.CreateContainerOptions) (bool, error)
+	// sent by CreateIfNotExists
+	Metadata() map[string]string
+	GetBlobReference(name string) blobRef
+	ListBlobs(params storage.ListBlobsParameters) (storage.BlobListResponse, error)
+}
+
+type blobRef interface {
+	// Properties and Metadata are filled by GetProperties and sent by
+	// PutPageBlob, SetProperties and SetMetadata
+	Properties() *storage.BlobProperties
+	Metadata() storage.BlobMetadata
+
+	Exists() (bool, error)
+	GetURL() string
+	GetProperties(options *storage.GetBlobPropertiesOptions) error
+	SetProperties(options *storage.SetBlobPropertiesOptions) error
+	SetMetadata(options *storage.SetBlobMetadataOptions) error
+	GetRange(options *storage.GetBlobRangeOptions) (io.ReadCloser, error)
+	PutPageBlob(options *storage.PutBlobOptions) error
+	WriteRange(blobRange storage.BlobRange, bytes io.Reader, options *storage.PutPageOptions) error
+	CreateSnapshot(options *storage.SnapshotOptions) (*time.Time, error)
+	Delete(options *storage.DeleteBlobOptions) error
+	AcquireLease(leaseTimeInSeconds int, proposedLeaseID string, options *storage.LeaseOptions) (string, error)
+	RenewLease(currentLeaseID string, options *storage.LeaseOptions) error
+	ReleaseLease(currentLeaseID string, options *storage.LeaseOptions) error
+	BreakLeaseWithBreakPeriod(breakPeriodInSeconds int, options *storage.LeaseOptions) (int, error)
+}
+
+// factory for the blob backend of an account
+type blobBackendFactory func(account string, key string, sasToken string) (blobBackend, error)
+
+// replaces the Azure SDK with backend for every account (tests)
+func withBlobBackend(backend blobBackend) ClientOption {
+	return func(c *dyskclient) {
+		c.newBackend = func(account string, key string, sasToken string) (blobBackend, error) {
+			return backend, nil
+		}
+	}
+}
+
+type sdkBlobService struct {
+	*storage.BlobStorageClient
+}
+
+func (s sdkBlobService) GetContainerReference(name string) blobContainer {
+	return sdkContainer{s.BlobStorageClient.GetContainerReference(name)}
+}
+
+type sdkContainer struct {
+	*storage.Container
+}
+
+func (sc sdkContainer) Metadata() map[string]string {
+	if nil == sc.Container.Metadata {
+		sc.Container.Metadata = map[string]string{}
+	}
+	return sc.Container.Metadata
+}
+
+func (sc sdkContainer) GetBlobReference(name string) blobRef {
+	return sdkBlob{sc.Container.GetBlobReference(name)}
+}
+
+type sdkBlob struct {
+	*storage.Blob
+}
+
+func (b sdkBlob) Properties() *storage.BlobProperties {
+	return &b.Blob.Properties
+}
+
+func (b sdkBlob) Metadata() storage.BlobMetadata {
+	if nil == b.Blob.Metadata {
+		b.Blob.Metadata = storage.BlobMetadata{}
+	}
+	return b.Blob.Metadata
+}
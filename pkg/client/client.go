@@ -2,30 +2,62 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/rubiojr/go-vhd/vhd"
 )
 
 const (
-	deviceFile = "/dev/dysk"
+	defaultDeviceFile = "/dev/dysk"
 	// IOCTL Command Codes
-	IOCTLMOUNTDYSK   = 9901
-	IOCTLUNMOUNTDYSK = 9902
-	IOCTGETDYSK      = 9903
-	IOCTLISTDYYSKS   = 9904
+	IOCTLMOUNTDYSK      = 9901
+	IOCTLUNMOUNTDYSK    = 9902
+	IOCTGETDYSK         = 9903
+	IOCTLISTDYYSKS      = 9904
+	IOCTLRESIZEDYSK     = 9905 // 9905 to 9910 are proposed, the shipped module fails them with ENOTTY
+	IOCTLMODULEINFO     = 9906
+	IOCTLPINGDYSK       = 9907
+	IOCTLSTATSDYSK      = 9908
+	IOCTLREMOUNTDYSK    = 9909
+	IOCTLAUTHUPDATEDYSK = 9910
 	// All in/out commands are expecting 2048 buffers.
 	IOCTL_IN_OUT_MAX = 2048
+	// Times an IOCTL interrupted by a signal is retried
+	IOCTL_EINTR_RETRIES = 8
+	// Format Azure uses for snapshot times
+	snapshotTimeFormat = "2006-01-02T15:04:05.0000000Z"
+	// Blob metadata recording whether a page blob was created as vhd
+	vhdMetadataKey = "dyskvhd"
+	// vhd subtype and, for dynamic vhds, the virtual disk size in bytes
+	vhdTypeMetadataKey = "dyskvhdtype"
+	vhdSizeMetadataKey = "dyskvhdsize"
+	// Blob lease state and duration as reported in blob properties
+	leaseStateLeased   = "leased"
+	leaseDurationFixed = "fixed"
+	// Auth modes passed to the kernel module
+	authSharedKey = "key"
+	authSAS       = "sas"
 )
 
 type DyskClient interface {
@@ -34,6 +66,52 @@ type DyskClient interface {
 	Get(name string) (*Dysk, error)
 	List() ([]*Dysk, error)
 	CreatePageBlob(sizeGB uint, container string, pageBlobName string, is_vhd bool) (string, error)
+	CreatePageBlobBytes(sizeBytes uint64, container string, pageBlobName string, is_vhd bool) (string, error)
+	MountContext(ctx context.Context, d *Dysk) error
+	MountWithOptions(ctx context.Context, d *Dysk, opts *MountOptions) error
+	MountWithResult(ctx context.Context, d *Dysk, opts *MountOptions) (*MountResult, error)
+	UnmountContext(ctx context.Context, name string) error
+	GetContext(ctx context.Context, name string) (*Dysk, error)
+	ListContext(ctx context.Context) ([]*Dysk, error)
+	CreatePageBlobContext(ctx context.Context, sizeGB uint, container string, pageBlobName string, is_vhd bool) (string, error)
+	CreatePageBlobBytesContext(ctx context.Context, sizeBytes uint64, container string, pageBlobName string, is_vhd bool) (string, error)
+	UnmountAndReleaseLease(name string) error
+	ForceUnmount(name string) error
+	UnmountGraceful(name string, timeout time.Duration) error
+	Resize(name string, newSizeBytes uint64) error
+	DeletePageBlob(container string, pageBlobName string, breakLease bool) error
+	Snapshot(name string) (snapshotTime string, err error)
+	UnmountAll(force bool) (unmounted []string, errs map[string]error)
+	GetByDevice(major int, minor int) (*Dysk, error)
+	UnmountByDevice(major int, minor int) error
+	ListDetailed() ([]*DyskInfo, error)
+	ListTolerant(ctx context.Context) ([]ListResult, error)
+	RawList() (string, error)
+	FlushDNSCache()
+	ModuleInfo() (*ModuleInfo, error)
+	CreatePageBlobWithSpec(ctx context.Context, spec *PageBlobSpec) (*PageBlobResult, error)
+	CreatePageBlobs(ctx context.Context, specs []PageBlobSpec) ([]PageBlobResult, error)
+	InspectBlob(container string, name string) (*BlobInfo, error)
+	ListPageBlobs(container string) ([]BlobInfo, error)
+	ProbeContent(d *Dysk, sectors int) ([]byte, error)
+	Ping(name string) error
+	Remount(name string, newType DyskType) error
+	RefreshCredentials(name string) error
+	RotateKey(name string, newKey string) error
+	VerifySize(name string) (kernelBytes uint64, blobBytes uint64, err error)
+	Stats(name string) (*DyskStats, error)
+	ListStats() (map[string]*DyskStats, error)
+	MountSpec(r io.Reader) ([]*Dysk, []error)
+	Reconcile(spec []*Dysk) (toMount []*Dysk, toUnmount []*Dysk, err error)
+	ListStream(ctx context.Context) (<-chan *Dysk, <-chan error)
+	DryRunMount(d *Dysk) error
+	WaitForDevice(name string, timeout time.Duration) (string, error)
+	OpenDevice(name string, flags int) (*os.File, error)
+	DebugMountString(d *Dysk) (string, error)
+	DebugMountStringWithSecrets(d *Dysk) (string, error)
+	Open() error
+	Close() error
+	StartLeaseRenewal(d *Dysk, interval time.Duration, onError func(error)) (stop func(), err error)
 }
 
 type moduleResponse struct {
@@ -44,391 +122,1752 @@ type moduleResponse struct {
 type dyskclient struct {
 	storageAccountName string
 	storageAccountKey  string
-	blobClient         storage.BlobStorageClient
-	f                  *os.File
+	sasToken           string
+	endpointSuffix     string
+	useHTTPS           bool
+	httpClient         *http.Client
+	httpTimeout        time.Duration
+	proxyURL           string
+	emulator           bool
+	retryMaxAttempts   int
+	retryBaseDelay     time.Duration
+	logger             Logger
+	allowIPv6          bool
+	dnsCacheTTL        time.Duration
+	dnsTimeout         time.Duration
+	dnsCache           dnsCache
+	ioctlBufferSize    int
+	moduleLock         sync.Mutex
+	moduleInfo         *ModuleInfo
+	sessionLock        sync.RWMutex
+	session            *os.File
+	blobLock           sync.Mutex
+	blobClient         blobBackend
+	newBackend         blobBackendFactory
+	mountHooks         MountHooks
+	deviceFile         string
+	observer           Observer
+	userAgent          string
+	sdkTelemetry       bool
+	// set by CreateClientWithBlobService
+	blobServiceInjected bool
+	// set by WithTokenCredential
+	tokenCredential      azcore.TokenCredential
+	delegatedSASLifetime time.Duration
+	delegationKeys       delegationKeyCache
 }
 
-func CreateClient(account string, key string) DyskClient {
+// ClientOption configures optional client behavior
+type ClientOption func(*dyskclient)
+
+// WithEndpointSuffix sets the storage endpoint suffix used for both the
+// blob service and the host passed to the kernel module
+// (e.g. core.usgovcloudapi.net, core.chinacloudapi.cn). Defaults to the
+// public cloud (core.windows.net)
+func WithEndpointSuffix(suffix string) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < len(suffix) {
+			c.endpointSuffix = suffix
+		}
+	}
+}
+
+// WithEndpoint points the blob service at a custom base URL (the part after
+// {account}.blob.) and scheme, e.g. a private storage stamp served over http.
+// SAS clients always use https
+func WithEndpoint(baseURL string, useHTTPS bool) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < len(baseURL) {
+			c.endpointSuffix = baseURL
+		}
+		c.useHTTPS = useHTTPS
+	}
+}
+
+// WithEmulator targets a local storage emulator (e.g. Azurite) on
+// 127.0.0.1 with its well known development account and key. It is meant
+// for blob operations (creating, inspecting, deleting page blobs) only. The
+// kernel module always connects to {account}.blob.{suffix} on port 80, so
+// mounting fails with ErrEmulatorMount
+func WithEmulator() ClientOption {
+	return func(c *dyskclient) {
+		c.emulator = true
+		c.useHTTPS = false
+		c.storageAccountName = storage.StorageEmulatorAccountName
+		c.storageAccountKey = storage.StorageEmulatorAccountKey
+		c.sasToken = ""
+	}
+}
+
+// WithHTTPClient sends all blob service requests through httpClient, e.g. one
+// with connection and TLS handshake timeouts. Defaults to the SDK's client.
+// WithHTTPTimeout and WithProxy apply on top of it whatever the order of
+// the options
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *dyskclient) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithHTTPTimeout bounds every blob service request (connect, TLS handshake
+// and reading the response) to timeout. It replaces the timeout of a
+// WithHTTPClient client. Requests are bounded to DEFAULT_HTTP_TIMEOUT if
+// neither sets one
+func WithHTTPTimeout(timeout time.Duration) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < timeout {
+			c.httpTimeout = timeout
+		}
+	}
+}
+
+// WithProxy sends blob service requests through an http(s):// or socks5://
+// proxy. Without it HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored. Only
+// the client's own calls to Azure use the proxy, the kernel module connects
+// to storage directly. A WithHTTPClient client keeps its transport settings,
+// it must use an *http.Transport (or none) for the proxy to be set on it
+func WithProxy(proxyURL string) ClientOption {
+	return func(c *dyskclient) {
+		c.proxyURL = proxyURL
+	}
+}
+
+// WithRetry retries Azure storage calls that fail with a transient error
+// (408, 429, 5xx or a network error) up to maxAttempts times in total, with
+// exponential backoff starting at baseDelay plus jitter. 403/404 and other
+// client errors are never retried
+func WithRetry(maxAttempts int, baseDelay time.Duration) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < maxAttempts {
+			c.retryMaxAttempts = maxAttempts
+		}
+		if 0 < baseDelay {
+			c.retryBaseDelay = baseDelay
+		}
+	}
+}
+
+// WithDeviceFile opens the dysk character device at path instead of
+// /dev/dysk, e.g. when it is bind mounted elsewhere in a container
+func WithDeviceFile(path string) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < len(path) {
+			c.deviceFile = path
+		}
+	}
+}
+
+// WithIOCTLBufferSize sets the IOCTL buffer size for modules built with a
+// buffer other than the default 2048 bytes. Both sides must agree, the module
+// always reads and writes its own buffer size. It is checked against the
+// BufferSize the module reports on first use, operations fail with
+// ErrBufferSizeMismatch if they differ
+func WithIOCTLBufferSize(size int) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < size {
+			c.ioctlBufferSize = size
+		}
+	}
+}
+
+func CreateClient(account string, key string, opts ...ClientOption) DyskClient {
 	c := dyskclient{
 		storageAccountName: account,
 		storageAccountKey:  key,
+		endpointSuffix:     storage.DefaultBaseURL,
+		useHTTPS:           true,
+		retryMaxAttempts:   1,
+		retryBaseDelay:     500 * time.Millisecond,
+		logger:             stderrLogger,
+		dnsCacheTTL:        30 * time.Second,
+		dnsTimeout:         5 * time.Second,
+		ioctlBufferSize:    IOCTL_IN_OUT_MAX,
+		deviceFile:         defaultDeviceFile,
+		observer:           nopObserver{},
+		userAgent:          defaultUserAgent,
+		sdkTelemetry:       true,
+
+		delegatedSASLifetime: DEFAULT_DELEGATED_SAS_LIFETIME,
+	}
+	c.newBackend = c.newBlobService
+	for _, opt := range opts {
+		opt(&c)
 	}
 	return &c
 }
 
-func (c *dyskclient) ensureBlobService() error {
-	storageClient, err := storage.NewBasicClient(c.storageAccountName, c.storageAccountKey)
+// CreateClientWithSAS creates a client that authenticates with a SAS token
+// instead of the account key. The token is also passed to the kernel module
+func CreateClientWithSAS(account string, sasToken string, opts ...ClientOption) DyskClient {
+	c := CreateClient(account, "", opts...).(*dyskclient)
+	c.sasToken = strings.TrimPrefix(sasToken, "?")
+	return c
+}
+
+// CreateClientWithBlobService creates a client that makes its Azure calls
+// with svc, e.g. one already set up with a custom transport or retries. svc
+// is used as is, the client never builds a blob service of its own for
+// account. The kernel module still authenticates on its own, dysks mounted
+// by this client must carry the account key (Dysk.AccountKey) or a SAS
+// token (Dysk.SASToken)
+func CreateClientWithBlobService(account string, svc storage.BlobStorageClient, opts ...ClientOption) DyskClient {
+	c := CreateClient(account, "", opts...).(*dyskclient)
+	c.blobClient = sdkBlobService{&svc}
+	c.blobServiceInjected = true
+	return c
+}
+
+// Returns the client's blob service, creating it on first use. Safe for
+// concurrent use
+func (c *dyskclient) ensureBlobService() (blobBackend, error) {
+	c.blobLock.Lock()
+	defer c.blobLock.Unlock()
+
+	if nil != c.blobClient {
+		return c.blobClient, nil
+	}
+
+	blobClient, err := c.newBackend(c.storageAccountName, c.storageAccountKey, c.sasToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	blobClient := storageClient.GetBlobService()
 	c.blobClient = blobClient
-	return nil
+	return blobClient, nil
+}
+
+func (c *dyskclient) newBlobService(account string, key string, sasToken string) (blobBackend, error) {
+	var storageClient storage.Client
+	if c.emulator {
+		var err error
+		storageClient, err = storage.NewEmulatorClient()
+		if nil != err {
+			return nil, err
+		}
+	} else if nil != c.tokenCredential && account == c.storageAccountName && 0 == len(key) && 0 == len(sasToken) {
+		// bearer tokens are added by the http client, an empty SAS keeps the
+		// SDK from signing requests itself
+		env := azure.PublicCloud
+		env.StorageEndpointSuffix = c.endpointSuffix
+		storageClient = storage.NewAccountSASClient(account, url.Values{}, env)
+	} else if 0 < len(sasToken) {
+		token, err := url.ParseQuery(sasToken)
+		if nil != err {
+			return nil, fmt.Errorf("Invalid SAS token. Error:%s", err.Error())
+		}
+		env := azure.PublicCloud
+		env.StorageEndpointSuffix = c.endpointSuffix
+		storageClient = storage.NewAccountSASClient(account, token, env)
+	} else {
+		var err error
+		storageClient, err = storage.NewClient(account, key, c.endpointSuffix, storage.DefaultAPIVersion, c.useHTTPS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	httpClient, err := c.blobHTTPClient()
+	if nil != c.tokenCredential && !c.emulator && account == c.storageAccountName && 0 == len(key) && 0 == len(sasToken) {
+		httpClient, err = c.bearerHTTPClient()
+	}
+	if nil != err {
+		return nil, err
+	}
+	if httpClient, err = c.setUserAgent(&storageClient, httpClient); nil != err {
+		return nil, err
+	}
+	if nil != httpClient {
+		storageClient.HTTPClient = httpClient
+	}
+	blobClient := storageClient.GetBlobService()
+	return sdkBlobService{&blobClient}, nil
+}
+
+// http client for the blob service. The WithHTTPClient client (if any) with
+// the timeout and proxy applied to a copy. There is always a timeout, it is
+// what ends SDK calls doWithContext stopped waiting on
+func (c *dyskclient) blobHTTPClient() (*http.Client, error) {
+	httpClient := &http.Client{}
+	if nil != c.httpClient {
+		*httpClient = *c.httpClient
+	}
+	if 0 < c.httpTimeout {
+		httpClient.Timeout = c.httpTimeout
+	}
+	if 0 == httpClient.Timeout {
+		httpClient.Timeout = DEFAULT_HTTP_TIMEOUT
+	}
+	if 0 == len(c.proxyURL) {
+		return httpClient, nil
+	}
+
+	proxy, err := url.Parse(c.proxyURL)
+	if nil != err {
+		return nil, fmt.Errorf("Invalid proxy url:%s. Error:%s", c.proxyURL, err.Error())
+	}
+
+	var transport *http.Transport
+	switch t := httpClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("WithProxy can not be used with a WithHTTPClient client whose transport is a %T, set the proxy on that transport instead", t)
+	}
+	transport.Proxy = http.ProxyURL(proxy)
+	httpClient.Transport = transport
+	return httpClient, nil
+}
+
+// blob service for an existing dysk. Dysks returned by the module carry
+// their own credentials which may differ from the client's (or the client
+// may have none at all)
+func (c *dyskclient) blobServiceForDysk(d *Dysk) (blobBackend, error) {
+	if d.AccountName == c.storageAccountName && (0 < len(c.storageAccountKey) || 0 < len(c.sasToken) || nil != c.tokenCredential || c.blobServiceInjected) {
+		return c.ensureBlobService()
+	}
+	return c.newBackend(d.AccountName, d.AccountKey, d.SASToken)
 }
 
 func (c *dyskclient) CreatePageBlob(sizeGB uint, container string, pageBlobName string, is_vhd bool) (string, error) {
-	if err := c.ensureBlobService(); nil != err {
+	return c.CreatePageBlobContext(context.Background(), sizeGB, container, pageBlobName, is_vhd)
+}
+
+func (c *dyskclient) CreatePageBlobContext(ctx context.Context, sizeGB uint, container string, pageBlobName string, is_vhd bool) (string, error) {
+	return c.CreatePageBlobBytesContext(ctx, uint64(sizeGB)*BYTES_PER_GB, container, pageBlobName, is_vhd)
+}
+
+func (c *dyskclient) CreatePageBlobBytes(sizeBytes uint64, container string, pageBlobName string, is_vhd bool) (string, error) {
+	return c.CreatePageBlobBytesContext(context.Background(), sizeBytes, container, pageBlobName, is_vhd)
+}
+
+func (c *dyskclient) CreatePageBlobBytesContext(ctx context.Context, sizeBytes uint64, container string, pageBlobName string, is_vhd bool) (string, error) {
+	res, err := c.CreatePageBlobWithSpec(ctx, &PageBlobSpec{
+		Container: container,
+		Name:      pageBlobName,
+		SizeBytes: sizeBytes,
+		Vhd:       is_vhd,
+	})
+	if nil != err {
 		return "", err
 	}
+	return res.LeaseId, nil
+}
 
-	blobContainer := c.blobClient.GetContainerReference(container)
-	sizeBytes := uint64(sizeGB * 1024 * 1024 * 1024)
+// DeletePageBlob deletes a page blob. It fails if the blob is mounted as a
+// dysk on this host. A leased blob can only be deleted with breakLease,
+// which breaks the lease immediately (a blob that is not leased is fine)
+func (c *dyskclient) DeletePageBlob(container string, pageBlobName string, breakLease bool) (err error) {
+	defer c.observe(OpDeletePageBlob, time.Now(), &err)
+	ctx := context.Background()
+	blobPath := "/" + container + "/" + pageBlobName
+
+	dysks, err := c.ListContext(ctx)
+	if nil != err && !errors.Is(err, ErrModuleNotLoaded) {
+		// device file is missing when the module is not loaded, nothing can be mounted then
+		return err
+	}
+	for _, d := range dysks {
+		if isBackedBy(d, blobPath) {
+			return fmt.Errorf("Page blob %s is mounted as dysk %s: %w", blobPath, d.Name, ErrBlobMounted)
+		}
+	}
 
-	_, err := blobContainer.CreateIfNotExists(nil)
+	blobClient, err := c.ensureBlobService()
 	if nil != err {
+		return err
+	}
+	pageBlob := blobClient.GetContainerReference(container).GetBlobReference(pageBlobName)
+
+	if breakLease {
+		err = c.doAzure(ctx, func() error {
+			_, err := pageBlob.BreakLeaseWithBreakPeriod(0, nil)
+			return err
+		})
+		// 409: there is no lease to break
+		if nil != err && !isAzureStatus(err, 409) {
+			return err
+		}
+	}
+
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.Delete(nil)
+	})
+	if isAzureStatus(err, 404) {
+		return fmt.Errorf("Blob at %s does not exist: %w", blobPath, ErrBlobNotFound)
+	}
+	return err
+}
+
+// Snapshot creates a snapshot of the page blob backing a mounted dysk and
+// returns its time, usable as Dysk.SnapshotTime.
+//
+// The snapshot is crash-consistent at best: it captures whatever the blob
+// holds at that moment. Writes still in the page cache or in flight are not
+// included, callers that need more should sync/fsfreeze the filesystem first
+func (c *dyskclient) Snapshot(name string) (_ string, err error) {
+	defer c.observe(OpSnapshot, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
 		return "", err
 	}
 
-	pageBlob := blobContainer.GetBlobReference(pageBlobName)
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return "", err
+	}
+	defer f.Close()
 
-	pageBlob.Properties.ContentLength = int64(sizeBytes)
-	err = pageBlob.PutPageBlob(nil)
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
 	if nil != err {
 		return "", err
 	}
 
-	fmt.Fprintf(os.Stderr, "Created PageBlob in account:%s %s/%s(%dGiB)\n", c.storageAccountName, container, pageBlobName, sizeGB)
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		return "", err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	blobContainer := blobClient.GetContainerReference(containerPath)
+	pageBlob := blobContainer.GetBlobReference(blobName)
 
-	// is it vhd?
-	h := vhd.CreateFixedHeader(uint64(sizeBytes), &vhd.VHDOptions{})
-	b := new(bytes.Buffer)
-	err = binary.Write(b, binary.BigEndian, h)
+	snapshotOptions := storage.SnapshotOptions{
+		LeaseID: d.LeaseId,
+	}
+	var snapshot *time.Time
+	err = c.doAzure(ctx, func() error {
+		var err error
+		snapshot, err = pageBlob.CreateSnapshot(&snapshotOptions)
+		return err
+	})
 	if nil != err {
 		return "", err
 	}
 
-	headerBytes := b.Bytes()
-	blobRange := storage.BlobRange{
-		Start: uint64(sizeBytes - uint64(len(headerBytes))),
-		End:   uint64(sizeBytes - 1),
+	return snapshot.UTC().Format(snapshotTimeFormat), nil
+}
+
+// StartLeaseRenewal renews the lease held by d on its page blob every
+// interval until stop is called. The lease is renewed once before returning,
+// later renewal failures are passed to onError (if not nil). Renewal only
+// talks to Azure, with d's credentials and the client's retries, it never
+// touches the device file
+func (c *dyskclient) StartLeaseRenewal(d *Dysk, interval time.Duration, onError func(error)) (func(), error) {
+	if 0 >= interval {
+		return nil, fmt.Errorf("Invalid lease renewal interval:%s", interval)
+	}
+	if 0 == len(d.LeaseId) {
+		return nil, fmt.Errorf("Dysk %s has no lease to renew", d.Name)
+	}
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		return nil, err
+	}
+
+	containerPath, blobName := blobPathParts(d.Path)
+	blobContainer := blobClient.GetContainerReference(containerPath)
+	pageBlob := blobContainer.GetBlobReference(blobName)
+	leaseId := d.LeaseId
+
+	// stop cancels a renewal that is retrying
+	ctx, cancel := context.WithCancel(context.Background())
+	renew := func() (err error) {
+		defer c.observe(OpRenewLease, time.Now(), &err)
+		return c.doAzure(ctx, func() error {
+			return pageBlob.RenewLease(leaseId, nil)
+		})
+	}
+	if err := renew(); nil != err {
+		cancel()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := renew(); nil != err && nil != onError {
+					onError(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			close(done)
+		})
+	}
+	return stop, nil
+}
+
+// MountResult is what MountWithResult gives back. d is updated the same way
+// (Major, Minor, SizeBytes..)
+type MountResult struct {
+	Major int
+	Minor int
+	// DevicePath is where udev creates the block device node, it may show
+	// up after Mount returns (see WaitForDevice)
+	DevicePath string
+	SizeBytes  uint64
+}
+
+func (c *dyskclient) Mount(d *Dysk) error {
+	return c.MountContext(context.Background(), d)
+}
+
+// MountContext mounts a dysk. ctx bounds DNS resolution and how long the
+// Azure calls made during validation are waited on, a call that is given up
+// on still runs until the http timeout (see WithHTTPTimeout). The IOCTL
+// itself can not be interrupted, ctx is checked right before it is issued
+func (c *dyskclient) MountContext(ctx context.Context, d *Dysk) error {
+	return c.MountWithOptions(ctx, d, nil)
+}
+
+// MountOptions changes how MountWithOptions mounts, nil is the same as Mount
+type MountOptions struct {
+	// SkipNameCheck skips listing mounted dysks to fail early with
+	// ErrNameInUse, for bulk mounts that already know the names are free
+	SkipNameCheck bool
+	// CreateIfMissing creates the page blob at d.Path if it does not exist,
+	// of d.SizeBytes (or d.SizeGB) bytes and vhd if d.Vhd, and leases it into
+	// d.LeaseId. The blob is created with the client's account. If the mount
+	// then fails the blob is released and deleted again
+	CreateIfMissing bool
+}
+
+// MountWithOptions is MountContext with opts
+func (c *dyskclient) MountWithOptions(ctx context.Context, d *Dysk, opts *MountOptions) error {
+	return c.mountWithOptions(ctx, d, opts)
+}
+
+// MountWithResult is MountWithOptions returning the mounted device's
+// numbers, /dev path and size, everything needed to start I/O
+func (c *dyskclient) MountWithResult(ctx context.Context, d *Dysk, opts *MountOptions) (*MountResult, error) {
+	if err := c.mountWithOptions(ctx, d, opts); nil != err {
+		return nil, err
+	}
+	return &MountResult{
+		Major:      d.Major,
+		Minor:      d.Minor,
+		DevicePath: path.Join(devPath, d.Name),
+		SizeBytes:  d.SizeBytes,
+	}, nil
+}
+
+func (c *dyskclient) mountWithOptions(ctx context.Context, d *Dysk, opts *MountOptions) (err error) {
+	defer c.observe(OpMount, time.Now(), &err)
+	if nil == opts {
+		opts = &MountOptions{}
+	}
+	hooks := &c.mountHooks
+	stage := MountStageValidate
+	defer func() {
+		if nil != err {
+			hooks.fireError(stage, d, err)
+		}
+	}()
+	hooks.fire(hooks.BeforeValidate, stage, d)
+
+	if err := c.checkNotEmulator(d); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	if !opts.SkipNameCheck {
+		if err := c.checkNameFree(ctx, f, d.Name); nil != err {
+			return err
+		}
+	}
+
+	if opts.CreateIfMissing {
+		var created *PageBlobSpec
+		created, err = c.createIfMissing(ctx, d)
+		if nil != err {
+			return err
+		}
+		if nil != created {
+			// a blob created for a mount that fails is not left leased behind
+			defer func() {
+				if nil != err {
+					err = c.undoCreateIfMissing(d, created, err)
+				}
+			}()
+		}
+	}
+
+	err = c.pre_mount(ctx, d)
+	if nil != err {
+		return err
+	}
+
+	if err := c.checkMountCapabilities(ctx, f, d); nil != err {
+		return err
+	}
+	hooks.fire(hooks.AfterValidate, stage, d)
+
+	stage = MountStageIOCTL
+	hooks.fire(hooks.BeforeIOCTL, stage, d)
+
+	as_string := dysk2string(d)
+	buffer, err := bufferize(as_string, c.ioctlBufferSize)
+	if nil != err {
+		return err
+	}
+
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	n, e := ioctl(f.Fd(), IOCTLMOUNTDYSK, buffer)
+	if e != 0 {
+		return &IOCTLError{Cmd: IOCTLMOUNTDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return err
+	}
+	if res.is_error {
+		return &ModuleResponseError{Response: res.response}
+	}
+
+	newdysk, err := string2dysk(res.response)
+	if nil != err {
+		return err
+	}
+	d.Major = newdysk.Major
+	d.Minor = newdysk.Minor
+
+	// the dysk is mounted, tuning is best effort
+	if err := c.applyQueueTuning(ctx, f, d); nil != err {
+		c.logger.Printf("Failed to set read ahead/queue depth for dysk %s:%s\n", d.Name, err.Error())
+	}
+	hooks.fire(hooks.AfterMount, MountStageMounted, d)
+	return nil
+}
+
+// creates d's page blob if it does not exist yet. Returns the spec it was
+// created with, nil if it existed
+func (c *dyskclient) createIfMissing(ctx context.Context, d *Dysk) (*PageBlobSpec, error) {
+	if 0 == len(c.storageAccountName) || (0 < len(d.AccountName) && d.AccountName != c.storageAccountName) {
+		return nil, fmt.Errorf("CreateIfMissing needs a client for the dysk's storage account")
+	}
+	if isMultiBlob(d) {
+		return nil, fmt.Errorf("CreateIfMissing is not supported for dysks backed by several page blobs")
+	}
+	if err := isValidBlobPath(d.Path); nil != err {
+		return nil, err
+	}
+
+	blobClient, err := c.ensureBlobService()
+	if nil != err {
+		return nil, err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	pageBlob := blobClient.GetContainerReference(containerPath).GetBlobReference(blobName)
+
+	var exists bool
+	err = c.doAzure(ctx, func() error {
+		var err error
+		exists, err = pageBlob.Exists()
+		return err
+	})
+	if nil != err {
+		return nil, err
+	}
+	if exists {
+		return nil, nil
+	}
+
+	sizeBytes := d.SizeBytes
+	if 0 == sizeBytes {
+		sizeBytes = uint64(d.SizeGB) * BYTES_PER_GB
+	}
+	if 0 == sizeBytes {
+		return nil, fmt.Errorf("Blob at %s does not exist, set SizeBytes or SizeGB to create it", d.Path)
+	}
+
+	spec := &PageBlobSpec{
+		Container: containerPath,
+		Name:      blobName,
+		SizeBytes: sizeBytes,
+		Vhd:       d.Vhd,
+		VhdType:   d.VhdType,
+	}
+	res, err := c.CreatePageBlobWithSpec(ctx, spec)
+	if nil != err {
+		return nil, err
+	}
+	d.LeaseId = res.LeaseId
+	return spec, nil
+}
+
+// releases and deletes the page blob createIfMissing created for a mount
+// that then failed with mountErr, the returned error says what became of it
+func (c *dyskclient) undoCreateIfMissing(d *Dysk, spec *PageBlobSpec, mountErr error) error {
+	blobClient, err := c.ensureBlobService()
+	if nil != err {
+		return fmt.Errorf("%w (the page blob %s created for the mount is left leased, it could not be deleted. Error:%s)", mountErr, d.Path, err.Error())
+	}
+	pageBlob := blobClient.GetContainerReference(spec.Container).GetBlobReference(spec.Name)
+	if !c.cleanupPageBlob(pageBlob, spec, d.LeaseId) {
+		return fmt.Errorf("%w (the page blob %s created for the mount could not be deleted, see the log)", mountErr, d.Path)
+	}
+	return fmt.Errorf("%w (the page blob %s created for the mount was deleted)", mountErr, d.Path)
+}
+
+// fails with ErrNameInUse if a dysk named name is mounted
+func (c *dyskclient) checkNameFree(ctx context.Context, f *deviceHandle, name string) error {
+	names, err := c.listNames(ctx, f)
+	if nil != err {
+		return err
+	}
+	for _, mounted := range names {
+		if mounted != name {
+			continue
+		}
+		d, err := c.get(ctx, f, name)
+		if nil != err {
+			return fmt.Errorf("Dysk name %s: %w", name, ErrNameInUse)
+		}
+		return fmt.Errorf("Dysk name %s is mounted with %s: %w", name, d.Path, ErrNameInUse)
+	}
+	return nil
+}
+
+// DryRunMount runs every check Mount does (credentials, blob type and lease,
+// DNS, size) and fills d's computed fields (sector count, host, ip, size)
+// without issuing the mount IOCTL. The kernel module is not needed
+func (c *dyskclient) DryRunMount(d *Dysk) error {
+	if err := c.pre_mount(context.Background(), d); nil != err {
+		return err
 	}
 
-	if err = pageBlob.WriteRange(blobRange, bytes.NewBuffer(headerBytes[:vhd.VHD_HEADER_SIZE]), nil); nil != err {
+	_, err := bufferize(dysk2string(d), c.ioctlBufferSize)
+	return err
+}
+
+// DebugMountString runs the same checks as DryRunMount and returns the
+// request Mount would send to the kernel module, with the account key, lease
+// id and SAS token masked
+func (c *dyskclient) DebugMountString(d *Dysk) (string, error) {
+	return c.debugMountString(d, false)
+}
+
+// DebugMountStringWithSecrets is DebugMountString without masking
+func (c *dyskclient) DebugMountStringWithSecrets(d *Dysk) (string, error) {
+	return c.debugMountString(d, true)
+}
+
+func (c *dyskclient) debugMountString(d *Dysk, withSecrets bool) (string, error) {
+	if err := c.DryRunMount(d); nil != err {
 		return "", err
 	}
 
-	fmt.Fprintf(os.Stderr, "Wrote VHD header for PageBlob in account:%s %s/%s\n", c.storageAccountName, container, pageBlobName)
+	as_string := dysk2string(d)
+	if withSecrets {
+		return as_string, nil
+	}
+	// accountkey, lease, sastoken, segments (carry lease ids)
+	return redactFields(strings.Split(as_string, "\n"), 4, 8, 11, 20), nil
+}
+
+func (c *dyskclient) Unmount(name string) error {
+	return c.UnmountContext(context.Background(), name)
+}
+
+func (c *dyskclient) UnmountContext(ctx context.Context, name string) (err error) {
+	defer c.observe(OpUnmount, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	return c.unmount(ctx, f, name)
+}
+
+// UnmountAndReleaseLease unmounts a dysk then releases the lease it held on
+// its page blob. A lease that is already gone (broken or released elsewhere)
+// or a blob that no longer exists is not an error
+func (c *dyskclient) UnmountAndReleaseLease(name string) (err error) {
+	defer c.observe(OpUnmount, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		return err
+	}
+
+	if err := c.unmount(ctx, f, name); nil != err {
+		return err
+	}
+
+	return c.releaseLease(ctx, d)
+}
+
+// ForceUnmount unmounts a dysk even when its blob or storage account is
+// unreachable, e.g. when draining a node. The lease is released best effort,
+// Azure errors are logged and never returned. Only a failed unmount fails
+func (c *dyskclient) ForceUnmount(name string) (err error) {
+	defer c.observe(OpUnmount, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		// unmount may still work, the lease is left as is
+		c.logger.Printf("Failed to read dysk %s before force unmount, its lease will not be released:%s\n", name, err.Error())
+	}
+
+	if err := c.unmount(ctx, f, name); nil != err {
+		return err
+	}
+
+	if nil != d {
+		if err := c.releaseLease(ctx, d); nil != err {
+			c.logger.Printf("Failed to release lease of %s for dysk %s:%s\n", d.Path, name, err.Error())
+		}
+	}
+	return nil
+}
+
+// UnmountGraceful flushes a dysk's dirty pages and waits for its in flight
+// I/O to complete before unmounting it. If that takes longer than timeout
+// the dysk is left mounted and the error matches ErrFlushTimeout. The module
+// keeps accepting I/O meanwhile, callers should stop their writers (or
+// unmount the filesystem) first
+func (c *dyskclient) UnmountGraceful(name string, timeout time.Duration) (err error) {
+	defer c.observe(OpUnmount, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		return err
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := drainDevice(drainCtx, d); nil != err {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("Dysk %s did not flush within %s, it is still mounted: %w", name, timeout, ErrFlushTimeout)
+		}
+		return err
+	}
+
+	return c.unmount(ctx, f, name)
+}
+
+func (c *dyskclient) Get(deviceName string) (*Dysk, error) {
+	return c.GetContext(context.Background(), deviceName)
+}
+
+func (c *dyskclient) GetContext(ctx context.Context, deviceName string) (_ *Dysk, err error) {
+	defer c.observe(OpGet, time.Now(), &err)
+	if err := ValidateDeviceName(deviceName); nil != err {
+		return nil, err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, err := c.get(ctx, f, deviceName)
+	if nil != err {
+		return nil, err
+	}
+
+	c.post_get(d)
+
+	return d, nil
+}
+
+func (c *dyskclient) List() ([]*Dysk, error) {
+	return c.ListContext(context.Background())
+}
+
+func (c *dyskclient) ListContext(ctx context.Context) (_ []*Dysk, err error) {
+	defer c.observe(OpList, time.Now(), &err)
+	var dysks []*Dysk
+
+	dyskChan, errChan := c.ListStream(ctx)
+	for d := range dyskChan {
+		dysks = append(dysks, d)
+	}
+	if err := <-errChan; nil != err {
+		return nil, err
+	}
+
+	return dysks, nil
+}
+
+// ListStream emits mounted dysks one at a time as each is read from the
+// module. The dysk channel is closed when listing is done, then the error
+// channel receives the error that stopped it (if any) and is closed
+func (c *dyskclient) ListStream(ctx context.Context) (<-chan *Dysk, <-chan error) {
+	dyskChan := make(chan *Dysk)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(errChan)
+		err := c.listStream(ctx, dyskChan)
+		close(dyskChan)
+		if nil != err {
+			errChan <- err
+		}
+	}()
+
+	return dyskChan, errChan
+}
+
+type getResult struct {
+	d   *Dysk
+	err error
+}
+
+// Gets are fanned out to a bounded pool of workers, each with its own device
+// file handle. Dysks are still emitted in list order
+func (c *dyskclient) listStream(ctx context.Context, dyskChan chan<- *Dysk) error {
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	names, err := c.listNames(ctx, f)
+	f.Close()
+	if nil != err {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan getResult, len(names))
+	for idx := range results {
+		results[idx] = make(chan getResult, 1)
+	}
+
+	// gets left once this returns fail fast on the cancelled ctx
+	go parallelWorkers(len(names), func() (func(int), func()) {
+		return c.getWorker(ctx, names, results)
+	})
+
+	for idx := range names {
+		var res getResult
+		select {
+		case res = <-results[idx]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if nil != res.err {
+			return res.err
+		}
+
+		select {
+		case dyskChan <- res.d:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// worker for parallelWorkers getting names[idx] into results[idx], with a
+// device file handle of its own
+func (c *dyskclient) getWorker(ctx context.Context, names []string, results []chan getResult) (func(idx int), func()) {
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return func(idx int) {
+			results[idx] <- getResult{err: err}
+		}, func() {}
+	}
+
+	return func(idx int) {
+		d, err := c.get(ctx, f, names[idx])
+		if nil == err {
+			c.post_get(d)
+		}
+		results[idx] <- getResult{d: d, err: err}
+	}, func() { f.Close() }
+}
+
+// GetByDevice gets a dysk by its block device major:minor
+func (c *dyskclient) GetByDevice(major int, minor int) (*Dysk, error) {
+	dysks, err := c.List()
+	if nil != err {
+		return nil, err
+	}
+
+	for _, d := range dysks {
+		if major == d.Major && minor == d.Minor {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("No dysk with device %d:%d: %w", major, minor, ErrDyskNotFound)
+}
+
+// UnmountByDevice unmounts a dysk by its block device major:minor
+func (c *dyskclient) UnmountByDevice(major int, minor int) error {
+	d, err := c.GetByDevice(major, minor)
+	if nil != err {
+		return err
+	}
+	return c.Unmount(d.Name)
+}
+
+// UnmountAll unmounts every dysk on the host and releases their leases.
+// Failures are collected per device instead of stopping at the first one.
+// A name is in unmounted only if the kernel unmounted it, if releasing its
+// lease then fails the name is also in errs. With force, lease errors
+// (including failing to read the dysk's lease) are ignored and only failed
+// unmounts are reported. Errors that prevent listing the dysks at all are
+// keyed by the empty name
+func (c *dyskclient) UnmountAll(force bool) ([]string, map[string]error) {
+	errs := make(map[string]error)
+	var unmounted []string
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		errs[""] = err
+		return nil, errs
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	names, err := c.listNames(ctx, f)
+	if nil != err {
+		errs[""] = err
+		return nil, errs
+	}
+
+	for _, name := range names {
+		d, err := c.get(ctx, f, name)
+		if nil != err && !force {
+			errs[name] = err
+			continue
+		}
+
+		start := time.Now()
+		err = c.unmount(ctx, f, name)
+		c.observe(OpUnmount, start, &err)
+		if nil != err {
+			errs[name] = err
+			continue
+		}
+		unmounted = append(unmounted, name)
+
+		if nil == d {
+			continue
+		}
+		if err := c.releaseLease(ctx, d); nil != err && !force {
+			errs[name] = err
+		}
+	}
+
+	return unmounted, errs
+}
+
+// --------------------------------
+// Utility Funcs
+// --------------------------------
+
+// Writes a fixed VHD footer at the end of a page blob of sizeBytes then
+// reads it back, writing it once more if the footer read is not valid
+func (c *dyskclient) writeVhdFooter(ctx context.Context, pageBlob blobRef, sizeBytes uint64, leaseId string) error {
+	var err error
+	for attempt := 1; attempt <= 2; attempt++ {
+		if err = c.putVhdFooter(ctx, pageBlob, sizeBytes, leaseId); nil != err {
+			return err
+		}
+
+		var footer []byte
+		footer, err = c.readVhdFooter(ctx, pageBlob, &storage.GetBlobOptions{LeaseID: leaseId})
+		if nil != err {
+			return err
+		}
+		if err = isValidVhdFooter(footer); nil == err {
+			c.logger.Printf("Verified VHD footer of PageBlob %s (attempt %d)\n", pageBlob.GetURL(), attempt)
+			return nil
+		}
+		c.logger.Printf("VHD footer of PageBlob %s failed verification (attempt %d). Error:%s\n", pageBlob.GetURL(), attempt, err.Error())
+	}
+	return err
+}
+
+func (c *dyskclient) putVhdFooter(ctx context.Context, pageBlob blobRef, sizeBytes uint64, leaseId string) error {
+	h := vhd.CreateFixedHeader(uint64(sizeBytes), &vhd.VHDOptions{})
+	b := new(bytes.Buffer)
+	err := binary.Write(b, binary.BigEndian, h)
+	if nil != err {
+		return err
+	}
+
+	headerBytes := b.Bytes()
+	blobRange := storage.BlobRange{
+		Start: uint64(sizeBytes - uint64(len(headerBytes))),
+		End:   uint64(sizeBytes - 1),
+	}
+	putPageOptions := storage.PutPageOptions{
+		LeaseID: leaseId,
+	}
+
+	return c.doAzure(ctx, func() error {
+		return pageBlob.WriteRange(blobRange, bytes.NewBuffer(headerBytes[:vhd.VHD_HEADER_SIZE]), &putPageOptions)
+	})
+}
+
+func (c *dyskclient) set_pageblob_size(ctx context.Context, d *Dysk) error {
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		return err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	blobContainer := blobClient.GetContainerReference(containerPath)
+
+	pageBlob := blobContainer.GetBlobReference(blobName)
+
+	// Read Properties if read && is page blog then we are cool
+	getProps, err := blobPropertiesOptions(d)
+	if nil != err {
+		return err
+	}
+
+	// Failed to read Properties?
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(getProps)
+	})
+	if isAzureStatus(err, 404) {
+		return fmt.Errorf("Failed to read size of %s: %w", d.Path, ErrBlobNotFound)
+	}
+	if d.IsReadWrite() && isLeaseMismatch(err) {
+		return leasedElsewhereError(d)
+	}
+	if isAzureStatus(err, 412) {
+		return fmt.Errorf("Failed to read size of %s, lease %s does not match the blob's lease. Error:%s", d.Path, d.LeaseId, err.Error())
+	}
+	if nil != err {
+		return fmt.Errorf("Failed to read size of %s. Error:%s", d.Path, err.Error())
+	}
+
+	// the flag recorded at creation is authoritative, blobs that predate it
+	// are taken as the caller says
+	if is_vhd, ok := vhdFromMetadata(pageBlob); ok && is_vhd != d.Vhd {
+		return fmt.Errorf("Blob at %s was created with vhd:%t, dysk has vhd:%t", d.Path, is_vhd, d.Vhd)
+	}
+	contentLength := pageBlob.Properties().ContentLength
+	if d.Vhd {
+		vhdType, sizeBytes, err := vhdTypeFromMetadata(pageBlob)
+		if nil != err {
+			return fmt.Errorf("Blob at %s: %s", d.Path, err.Error())
+		}
+		d.VhdType = vhdType
+		if VhdDynamic == vhdType {
+			contentLength = int64(sizeBytes)
+		}
+	}
+	computeSize(d, contentLength)
+	if 0 != d.declaredSizeGB && d.declaredSizeGB != d.SizeGB {
+		return fmt.Errorf("Blob at %s is %d GB, dysk %s declares %d GB", d.Path, d.SizeGB, d.Name, d.declaredSizeGB)
+	}
+	return nil
+}
+
+// vhd flag recorded on the blob at creation. ok is false for blobs that
+// predate it (or were not created by dysk)
+func vhdFromMetadata(pageBlob blobRef) (is_vhd bool, ok bool) {
+	v, ok := pageBlob.Metadata()[vhdMetadataKey]
+	if !ok {
+		return false, false
+	}
+	return "1" == v, true
+}
+
+func (c *dyskclient) pre_mount(ctx context.Context, d *Dysk) error {
+	if err := c.checkNotEmulator(d); nil != err {
+		return err
+	}
+
+	// a client without an account (e.g. remounting a dysk returned by Get)
+	// mounts with the dysk's own credentials
+	if 0 < len(c.storageAccountName) {
+		d.AccountName = c.storageAccountName
+		// the kernel's credentials come with the dysk for injected blob services
+		if !c.blobServiceInjected {
+			d.AccountKey = c.storageAccountKey
+			d.SASToken = c.sasToken
+		}
+	}
+
+	if isMultiBlob(d) {
+		if err := c.isValidSegments(d); nil != err {
+			return err
+		}
+	}
+	if err := isValidBlobPath(d.Path); nil != err {
+		return err
+	}
+
+	if nil != c.tokenCredential && d.AccountName == c.storageAccountName {
+		sas, err := c.delegatedSAS(ctx, d)
+		if nil != err {
+			return fmt.Errorf("Failed to create a SAS for %s. Error:%s", d.Path, err.Error())
+		}
+		d.SASToken = sas
+	}
+
+	if 0 == d.SectorSize {
+		d.SectorSize = DEFAULT_SECTOR_SIZE
+	}
+	if err := isValidSectorSize(d.SectorSize); nil != err {
+		return err
+	}
+
+	if isMultiBlob(d) {
+		if err := c.set_segment_sizes(ctx, d); nil != err {
+			return err
+		}
+	} else if err := c.set_pageblob_size(ctx, d); nil != err {
+		return err
+	}
+	return c.validateDysk(ctx, d)
+}
+
+func (c *dyskclient) post_get(d *Dysk) {
+	// Convert sector count to size, the module reports whether we are vhd
+	if 0 == d.SectorSize {
+		d.SectorSize = DEFAULT_SECTOR_SIZE
+	}
+	computeSize(d, blobSizeFromSectors(d))
+}
+
+func (c *dyskclient) unmount(ctx context.Context, f *deviceHandle, name string) error {
+	buffer, err := bufferize(frameName(name), c.ioctlBufferSize)
+	if nil != err {
+		return err
+	}
+
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	n, e := ioctl(f.Fd(), IOCTLUNMOUNTDYSK, buffer)
+	if e != 0 {
+		return &IOCTLError{Cmd: IOCTLUNMOUNTDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return err
+	}
+	if res.is_error {
+		return &ModuleResponseError{Response: res.response}
+	}
+
+	return nil
+}
+
+func (c *dyskclient) releaseLease(ctx context.Context, d *Dysk) error {
+	if isMultiBlob(d) {
+		var firstErr error
+		for idx := range d.Paths {
+			if err := c.releaseLease(ctx, segmentDysk(d, idx)); nil != err && nil == firstErr {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	if 0 == len(d.LeaseId) {
+		return nil
+	}
+
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		return err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	blobContainer := blobClient.GetContainerReference(containerPath)
+	pageBlob := blobContainer.GetBlobReference(blobName)
+
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.ReleaseLease(d.LeaseId, nil)
+	})
+	// 404: blob is gone, 409: lease was broken, released or changed elsewhere
+	if nil != err && !isAzureStatus(err, 404, 409) {
+		return err
+	}
+	return nil
+}
+
+// names of all mounted dysks
+func (c *dyskclient) listNames(ctx context.Context, f *deviceHandle) ([]string, error) {
+	response, err := c.rawList(ctx, f)
+	if nil != err {
+		return nil, err
+	}
+
+	var names []string
+	// the module may or may not end the list with a new line
+	for _, name := range strings.Split(response, "\n") {
+		name = strings.TrimSpace(strings.Trim(name, "\x00"))
+		if 0 == len(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// RawList returns the module's list response as is, after the OK status line
+// and without the NUL padding. Meant for debugging, List parses it
+func (c *dyskclient) RawList() (string, error) {
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return "", err
+	}
+	defer f.Close()
+
+	return c.rawList(context.Background(), f)
+}
+
+func (c *dyskclient) rawList(ctx context.Context, f *deviceHandle) (string, error) {
+	buffer, err := bufferize("-", c.ioctlBufferSize)
+	if nil != err {
+		return "", err
+	}
+	if err := ctx.Err(); nil != err {
+		return "", err
+	}
+	n, e := ioctl(f.Fd(), IOCTLISTDYYSKS, buffer)
+	if e != 0 {
+		return "", &IOCTLError{Cmd: IOCTLISTDYYSKS, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return "", err
+	}
+	if res.is_error {
+		return "", &ModuleResponseError{Response: res.response}
+	}
+	return res.response, nil
+}
+
+func (c *dyskclient) get(ctx context.Context, f *deviceHandle, deviceName string) (*Dysk, error) {
+	buffer, err := bufferize(frameName(deviceName), c.ioctlBufferSize)
+	if nil != err {
+		return nil, err
+	}
+
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	n, e := ioctl(f.Fd(), IOCTGETDYSK, buffer)
+	if e != 0 {
+		return nil, &IOCTLError{Cmd: IOCTGETDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return nil, err
+	}
+	if res.is_error {
+		return nil, &ModuleResponseError{Response: res.response}
+	}
 
-	// lease it
-	leaseId, err := pageBlob.AcquireLease(-1, "", nil)
+	d, err := string2dysk(res.response)
 	if nil != err {
-		return "", err
+		return nil, err
 	}
 
-	return leaseId, err
+	return d, nil
 }
 
-func (c *dyskclient) closeDeviceFile() error {
-	if nil == c.f {
-		return fmt.Errorf("Device file is not open")
-	}
-	return c.f.Close()
-}
+func (c *dyskclient) validateLease(ctx context.Context, d *Dysk) error {
 
-func (c *dyskclient) Mount(d *Dysk) error {
-	if err := c.openDeviceFile(); nil != err {
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
 		return err
 	}
-	defer c.closeDeviceFile()
+	containerPath, blobName := blobPathParts(d.Path)
 
-	err := c.pre_mount(d)
+	// Read Properties if read && is page blog then we are cool
+	getProps, err := blobPropertiesOptions(d)
 	if nil != err {
 		return err
 	}
 
-	as_string := dysk2string(d)
-	buffer := bufferize(as_string)
-
-	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, c.f.Fd(), IOCTLMOUNTDYSK, uintptr(unsafe.Pointer(&buffer[0])))
-	if e != 0 {
-		return e
-	}
-
-	res := parseResponse(buffer)
-	if res.is_error {
-		return fmt.Errorf(res.response)
+	pageBlob, err := c.blobWithProperties(ctx, blobClient, containerPath, blobName, getProps)
+	if d.IsReadWrite() && isLeaseMismatch(err) {
+		return leasedElsewhereError(d)
 	}
-
-	newdysk, err := string2dysk(res.response)
 	if nil != err {
 		return err
 	}
-	d.Major = newdysk.Major
-	d.Minor = newdysk.Minor
-	return nil
-}
 
-func (c *dyskclient) Unmount(name string) error {
-	if err := isValidDeviceName(name); nil != err {
-		return err
+	if storage.BlobTypePage != pageBlob.Properties().BlobType {
+		return fmt.Errorf("Blob at %s: %w", d.Path, ErrNotPageBlob)
 	}
 
-	if err := c.openDeviceFile(); nil != err {
-		return err
+	if 0 < len(d.LeaseId) {
+		if err := c.checkLeaseState(d, pageBlob); nil != err {
+			return err
+		}
+	}
+
+	if d.Vhd {
+		if err := c.verifyVhdFooter(ctx, d, pageBlob, getProps); nil != err {
+			return err
+		}
 	}
-	defer c.closeDeviceFile()
 
-	newName := fmt.Sprintf("%s\n\x00", name)
-	buffer := bufferize(newName)
+	//if dysk is readonly then we are done now
+	if d.IsReadOnly() {
+		return nil
+	}
 
-	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, c.f.Fd(), IOCTLUNMOUNTDYSK, uintptr(unsafe.Pointer(&buffer[0])))
-	if e != 0 {
-		return e
+	pageBlob.Metadata()["dysk"] = "dysk" //Setting a metadata value to ensure that we have write lease
+	setMetaDataProps := storage.SetBlobMetadataOptions{
+		LeaseID: d.LeaseId,
 	}
 
-	res := parseResponse(buffer)
-	if res.is_error {
-		return fmt.Errorf(res.response)
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.SetMetadata(&setMetaDataProps)
+	})
+	if isLeaseMismatch(err) {
+		return leasedElsewhereError(d)
+	}
+	if isAzureStatus(err, 412) {
+		return fmt.Errorf("Blob at %s is not leased, RW dysks need the blob leased with lease %s. Error:%s", d.Path, d.LeaseId, err.Error())
+	}
+	if nil != err {
+		return err
 	}
 
 	return nil
 }
 
-func (c *dyskclient) Get(deviceName string) (*Dysk, error) {
-	if err := isValidDeviceName(deviceName); nil != err {
-		return nil, err
+func (c *dyskclient) validateDysk(ctx context.Context, d *Dysk) error {
+	// snapshots are read only
+	if 0 < len(d.SnapshotTime) {
+		if 0 == len(d.Type) {
+			d.Type = ReadOnly
+		}
+		if d.IsReadWrite() {
+			return fmt.Errorf("Invalid type. Snapshots can only be mounted as R")
+		}
+		if _, err := time.Parse(time.RFC3339Nano, d.SnapshotTime); nil != err {
+			return fmt.Errorf("Invalid snapshot time:%s. Error:%s", d.SnapshotTime, err.Error())
+		}
 	}
 
-	if err := c.openDeviceFile(); nil != err {
-		return nil, err
+	if !d.Type.Valid() {
+		return fmt.Errorf("Invalid type. Must be R or RW")
 	}
-	defer c.closeDeviceFile()
 
-	d, err := c.get(deviceName)
-	if nil != err {
-		return nil, err
+	if err := isValidMountName(d.Name); nil != err {
+		return err
 	}
 
-	c.post_get(d)
-
-	return d, nil
-}
-
-func (c *dyskclient) List() ([]*Dysk, error) {
-	if err := c.openDeviceFile(); nil != err {
-		return nil, err
+	if err := isValidSectorSize(d.SectorSize); nil != err {
+		return err
 	}
-	defer c.closeDeviceFile()
-
-	var dysks []*Dysk
 
-	buffer := bufferize("-")
-	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, c.f.Fd(), IOCTLISTDYYSKS, uintptr(unsafe.Pointer(&buffer[0])))
-	if e != 0 {
-		return nil, e
+	if err := isValidQueueTuning(d); nil != err {
+		return err
 	}
 
-	res := parseResponse(buffer)
-	if res.is_error {
-		return nil, fmt.Errorf(res.response)
+	if 0 == len(d.CacheMode) {
+		d.CacheMode = CacheModeNone
+	}
+	if err := isValidCacheMode(d); nil != err {
+		return err
 	}
 
-	splitNames := strings.Split(res.response, "\n")
-	for idx, name := range splitNames {
-		if idx == (len(splitNames) - 1) {
-			break
+	if 0 < len(d.VhdType) {
+		if !d.Vhd {
+			return fmt.Errorf("Invalid vhd type %s for a dysk that is not vhd", d.VhdType)
 		}
-		d, err := c.get(name)
-		if nil != err {
-			return nil, err
+		if err := isValidVhdType(d.VhdType); nil != err {
+			return err
 		}
-		c.post_get(d)
-		dysks = append(dysks, d)
 	}
 
-	return dysks, nil
-}
-
-// --------------------------------
-// Utility Funcs
-// --------------------------------
-func (c *dyskclient) set_pageblob_size(d *Dysk) error {
-	c.ensureBlobService()
-	blobClient := c.blobClient
-	containerPath := path.Dir(d.Path)
-	containerPath = containerPath[1:]
-	blobContainer := blobClient.GetContainerReference(containerPath)
-
-	pageBlobName := path.Base(d.Path)
-	pageBlob := blobContainer.GetBlobReference(pageBlobName)
-
-	// Read Properties if read && is page blog then we are cool
-	getProps := storage.GetBlobPropertiesOptions{
-		LeaseID: d.LeaseId,
+	if 0 == d.sectorCount {
+		return fmt.Errorf("Invalid Sector count.")
 	}
 
-	// Failed to read Properties?
-	if err := pageBlob.GetProperties(&getProps); nil != err {
+	if err := isValidAccountName(d.AccountName); nil != err {
 		return err
 	}
 
-	d.SizeGB = int(pageBlob.Properties.ContentLength / (1024 * 1024 * 1024))
-	return nil
-}
-func (c *dyskclient) pre_mount(d *Dysk) error {
-	d.AccountName = c.storageAccountName
-	d.AccountKey = c.storageAccountKey
-
-	c.set_pageblob_size(d) /* TODO: Merge size functions in one place for validation and set_pageblob_size */
+	if 0 < len(d.SASToken) {
+		if SAS_TOKEN_LEN < len(d.SASToken) || strings.Contains(d.SASToken, "\n") {
+			return fmt.Errorf("Invalid SAS token. Must be <= %d and a single line", SAS_TOKEN_LEN)
+		}
+	} else {
+		if 0 == len(d.AccountKey) || ACCOUNT_KEY_LEN < len(d.AccountKey) {
+			return fmt.Errorf("Invalid AccountKey. Must be <= %d", ACCOUNT_KEY_LEN)
+		}
 
-	byteSize := d.SizeGB * (1024 * 1024 * 1024)
-	if d.Vhd {
-		byteSize -= vhd.VHD_HEADER_SIZE
+		_, err := base64.StdEncoding.DecodeString(d.AccountKey)
+		if nil != err {
+			return fmt.Errorf("Invalid account key. Must be a base64 encoded string. Error:%s", err.Error())
+		}
 	}
-	d.sectorCount = uint64(byteSize / 512)
-	return c.validateDysk(d)
-}
-
-func (c *dyskclient) post_get(d *Dysk) {
-	// Convert sector count to size
-	// check if we are VHD by measuring the difference between azure's size and disk size
 
-	byteSize := uint64(d.sectorCount * 512)
-	if d.Vhd {
-		byteSize += vhd.VHD_HEADER_SIZE
+	if err := isValidBlobPath(d.Path); nil != err {
+		return err
+	}
+	if BLOB_PATH_LEN < len(kernelPath(d)) {
+		return fmt.Errorf("Invalid path. Must be <= %d (including snapshot)", BLOB_PATH_LEN)
 	}
 
-	d.SizeGB = int(byteSize / (1024 * 1024 * 1024))
-}
-
-func (c *dyskclient) get(deviceName string) (*Dysk, error) {
-	newName := fmt.Sprintf("%s\n\x00", deviceName)
-	buffer := bufferize(newName)
-
-	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, c.f.Fd(), IOCTGETDYSK, uintptr(unsafe.Pointer(&buffer[0])))
-	if e != 0 {
-		return nil, e
+	// a caller supplied endpoint (SetResolvedEndpoint) is used as is
+	resolve := 0 == len(d.host) || 0 == len(d.ip)
+	if resolve {
+		d.host = c.blobHost(d.AccountName)
+	} else if err := isValidEndpoint(d.host, d.ip); nil != err {
+		return err
 	}
 
-	res := parseResponse(buffer)
-	if res.is_error {
-		return nil, fmt.Errorf(res.response)
+	// only RW dysks need a lease, R dysks (and snapshots, which can not be
+	// leased) may mount unleased blobs
+	if d.IsReadWrite() && 0 == len(d.LeaseId) {
+		return fmt.Errorf("Invalid Lease Id. RW dysks require a lease")
+	}
+	if LEASE_ID_LEN < len(d.LeaseId) {
+		return fmt.Errorf("Invalid Lease Id. Must be <= %d", LEASE_ID_LEN)
 	}
 
-	d, err := string2dysk(res.response)
-	if nil != err {
-		return nil, err
+	if resolve {
+		ip, err := c.resolveHost(ctx, d.host)
+		if nil != err {
+			return err
+		}
+		d.ip = ip
 	}
 
-	return d, nil
+	return c.validateLeases(ctx, d)
 }
 
-func (c *dyskclient) validateLease(d *Dysk) error {
+// the kernel module only talks to Azure, see WithEmulator
+func (c *dyskclient) checkNotEmulator(d *Dysk) error {
+	if c.emulator {
+		return fmt.Errorf("Can not mount %s, the kernel module can not reach a storage emulator: %w", d.Name, ErrEmulatorMount)
+	}
+	return nil
+}
 
-	blobClient := c.blobClient
-	containerPath := path.Dir(d.Path)
-	containerPath = containerPath[1:]
-	blobContainer := blobClient.GetContainerReference(containerPath)
+// host name the kernel module sends blob requests to
+func (c *dyskclient) blobHost(account string) string {
+	return fmt.Sprintf("%s.blob.%s", account, c.endpointSuffix)
+}
 
-	exists, err := blobContainer.Exists()
-	if nil != err {
+// Gets a blob's properties, failing with ErrContainerNotFound or
+// ErrBlobNotFound if either is missing
+func (c *dyskclient) blobWithProperties(ctx context.Context, blobClient blobBackend, container string, name string, getProps *storage.GetBlobPropertiesOptions) (blobRef, error) {
+	blobPath := "/" + container + "/" + name
+	blobContainer := blobClient.GetContainerReference(container)
+
+	var exists bool
+	err := c.doAzure(ctx, func() error {
+		var err error
+		exists, err = blobContainer.Exists()
 		return err
+	})
+	if nil != err {
+		return nil, err
 	}
 	if !exists {
-		return fmt.Errorf("Container at %s does not exist", d.Path)
+		return nil, fmt.Errorf("Container at %s does not exist: %w", blobPath, ErrContainerNotFound)
 	}
 
-	pageBlobName := path.Base(d.Path)
-	pageBlob := blobContainer.GetBlobReference(pageBlobName)
+	pageBlob := blobContainer.GetBlobReference(name)
 
-	exists, err = pageBlob.Exists()
-	if nil != err {
+	err = c.doAzure(ctx, func() error {
+		var err error
+		exists, err = pageBlob.Exists()
 		return err
+	})
+	if nil != err {
+		return nil, err
 	}
 	if !exists {
-		return fmt.Errorf("Blob at %s does not exist", d.Path)
-	}
-
-	// Read Properties if read && is page blog then we are cool
-	getProps := storage.GetBlobPropertiesOptions{
-		LeaseID: d.LeaseId,
+		return nil, fmt.Errorf("Blob at %s does not exist: %w", blobPath, ErrBlobNotFound)
 	}
 
 	// Failed to read Properties?
-	if err = pageBlob.GetProperties(&getProps); nil != err {
-		return err
-	}
-
-	if storage.BlobTypePage != pageBlob.Properties.BlobType {
-		return fmt.Errorf("This blob is not a page blob")
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(getProps)
+	})
+	if nil != err {
+		return nil, err
 	}
+	return pageBlob, nil
+}
 
-	//if dysk is readonly then we are done now
-	if ReadOnly == d.Type {
-		return nil
+// Waits on an Azure SDK call, which has no context support of its own. If ctx
+// is done first ctx's error is returned right away but the call is not
+// cancelled: it keeps running until it completes or hits the blob http
+// client's timeout (WithHTTPTimeout, DEFAULT_HTTP_TIMEOUT by default) and
+// may still take effect
+func doWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); nil != err {
+		return err
 	}
 
-	pageBlob.Metadata["dysk"] = "dysk" //Setting a metadata value to ensure that we have write lease
-	setMetaDataProps := storage.SetBlobMetadataOptions{
-		LeaseID: d.LeaseId,
-	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
 
-	if err = pageBlob.SetMetadata(&setMetaDataProps); nil != err {
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return nil
 }
 
-/* TODO: use length constants */
-func (c *dyskclient) validateDysk(d *Dysk) error {
-	if 0 == len(d.Type) || (ReadOnly != d.Type && ReadWrite != d.Type) {
-		return fmt.Errorf("Invalid type. Must be R or RW")
-	}
-
-	// lower the name
-	if 0 == len(d.Name) || 32 < len(d.Name) {
-		return fmt.Errorf("Invalid name. Only max of(32) chars")
-	}
+// Runs an Azure SDK call with the client's retry policy
+func (c *dyskclient) doAzure(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := doWithContext(ctx, fn)
+		if nil == err || nil != ctx.Err() || attempt >= c.retryMaxAttempts || !isRetriable(err) {
+			return err
+		}
 
-	if strings.Contains(d.Name, "/") || strings.Contains(d.Name, "\\") || strings.Contains(d.Name, ".") {
-		return fmt.Errorf("Invalid name. Must not contain \\ / .")
+		// exponential backoff, half of it jittered
+		delay := c.retryBaseDelay << uint(attempt-1)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	if 0 == d.sectorCount {
-		return fmt.Errorf("Invalid Sector count.")
+func isRetriable(err error) bool {
+	if isAzureStatus(err, 408, 429, 500, 502, 503, 504) {
+		return true
 	}
+	_, isNetErr := err.(net.Error)
+	return isNetErr
+}
 
-	if 0 == len(d.AccountName) || 256 < len(d.AccountName) {
-		return fmt.Errorf("Invalid Account name. Must be <= than 256")
+// true if err is Azure rejecting a lease id that is not the blob's current lease
+func isLeaseMismatch(err error) bool {
+	if !isAzureStatus(err, 409, 412) {
+		return false
 	}
-
-	if 0 == len(d.AccountKey) || 128 < len(d.AccountKey) {
-		return fmt.Errorf("Invalid AccountKey. Must be <= 64")
+	var code string
+	switch e := err.(type) {
+	case storage.AzureStorageServiceError:
+		code = e.Code
+	case *storage.AzureStorageServiceError:
+		code = e.Code
 	}
+	return "LeaseIdMismatchWithBlobOperation" == code || "LeaseIdMismatchWithLeaseOperation" == code
+}
 
-	_, err := base64.StdEncoding.DecodeString(d.AccountKey)
-	if nil != err {
-		fmt.Errorf("Invalid account key. Must be a base64 encoded string. Error:%s", err.Error())
+// a lease that is breaking, broken or expired may still accept its id for a
+// while, the kernel would start failing I/O shortly after the mount. An
+// empty state (not reported) is not checked
+func (c *dyskclient) checkLeaseState(d *Dysk, pageBlob blobRef) error {
+	props := pageBlob.Properties()
+	if 0 < len(props.LeaseState) && leaseStateLeased != props.LeaseState {
+		return fmt.Errorf("Blob at %s has lease state %s, lease %s must be active (leased)", d.Path, props.LeaseState, d.LeaseId)
 	}
-
-	if 0 == len(d.Path) || 1024 < len(d.Path) {
-		return fmt.Errorf("Invalid path. Must be <= 1024")
+	if leaseDurationFixed == props.LeaseDuration {
+		c.logger.Printf("Blob at %s has a fixed duration lease, it expires unless renewed (see StartLeaseRenewal)\n", d.Path)
 	}
+	return nil
+}
 
-	if 0 < len(d.host) && 512 < len(d.host) {
-		return fmt.Errorf("Invalid host. Must be <= 512")
-	} else {
-		d.host = fmt.Sprintf("%s.blob.core.windows.net", d.AccountName) // Won't support sovereign clouds for now
-	}
+func leasedElsewhereError(d *Dysk) error {
+	return fmt.Errorf("Blob at %s is leased with a lease id other than %s, it may be mounted RW on another host: %w", d.Path, d.LeaseId, ErrLeasedElsewhere)
+}
 
-	if 0 == len(d.LeaseId) || 64 < len(d.LeaseId) {
-		return fmt.Errorf("Invalid Lease Id. Must be <= 32")
+// true if err is an azure storage error with one of the status codes
+func isAzureStatus(err error, codes ...int) bool {
+	var statusCode int
+	switch e := err.(type) {
+	case storage.AzureStorageServiceError:
+		statusCode = e.StatusCode
+	case *storage.AzureStorageServiceError:
+		statusCode = e.StatusCode
+	default:
+		return false
 	}
-
-	addr, err := net.LookupIP(d.host)
-	if nil != err {
-		return fmt.Errorf("Failed to lookup ip for host:%s", d.host)
+	for _, code := range codes {
+		if code == statusCode {
+			return true
+		}
 	}
-	d.ip = addr[0].String()
-
-	return c.validateLease(d)
+	return false
 }
 
 // Converts a byte slice to a response object
-func parseResponse(bytes []byte) *moduleResponse {
+func parseResponse(bytes []byte) (*moduleResponse, error) {
+	// number of bytes included in errors for malformed responses
+	const dumpLen = 64
+
+	// callers pass the reply's length, a NUL still ends it early
 	s := string(bytes)
+	if end := strings.IndexByte(s, 0); 0 <= end {
+		s = s[:end]
+	}
 	firstlinebreak := strings.Index(s, "\n")
+	if firstlinebreak < 0 {
+		n := dumpLen
+		if len(bytes) < n {
+			n = len(bytes)
+		}
+		return nil, fmt.Errorf("Invalid response from module, no status line. First %d bytes:\n%s", n, hex.Dump(bytes[:n]))
+	}
 	is_error := s[:firstlinebreak] == "ERR"
 	response := s[firstlinebreak+1:]
 
@@ -437,44 +1876,136 @@ func parseResponse(bytes []byte) *moduleResponse {
 		response: response,
 	}
 
-	return res
+	return res, nil
 }
 
 // Converts a string to a dysk
 func string2dysk(asstring string) (*Dysk, error) {
+	//type-devicename-sectorcount-accountname-accountkey-path-host-ip-lease-major-minor-vhd
+	const minFields = 12
 	split := strings.Split(asstring, "\n")
+	if len(split) < minFields {
+		return nil, fmt.Errorf("Invalid dysk response from module, expected at least %d fields got %d. Response:%q", minFields, len(split), redactResponse(split))
+	}
+
+	sectorCount, err := strconv.ParseUint(split[2], 10, 64)
+	if nil != err {
+		return nil, fmt.Errorf("Invalid sector count in module response. Error:%s Response:%q", err.Error(), redactResponse(split))
+	}
 
-	sectorCount, _ := strconv.ParseUint(split[2], 10, 64)
 	major, err := strconv.ParseInt(split[9], 10, 64)
 	if nil != err {
-		return nil, err
+		return nil, fmt.Errorf("Invalid major in module response. Error:%s Response:%q", err.Error(), redactResponse(split))
 	}
 
 	minor, err := strconv.ParseInt(split[10], 10, 64)
 	if nil != err {
-		return nil, err
+		return nil, fmt.Errorf("Invalid minor in module response. Error:%s Response:%q", err.Error(), redactResponse(split))
 	}
+
 	is_vhd, err := strconv.ParseInt(split[11], 10, 64)
+	if nil != err {
+		return nil, fmt.Errorf("Invalid vhd flag in module response. Error:%s Response:%q", err.Error(), redactResponse(split))
+	}
 
+	blobPath, snapshotTime := splitKernelPath(split[5])
 	d := Dysk{
-		Type:        DyskType(split[0]),
-		Name:        split[1],
-		sectorCount: sectorCount,
-		AccountName: split[3],
-		AccountKey:  split[4],
-		Path:        split[5],
-		host:        split[6],
-		ip:          split[7],
-		LeaseId:     split[8],
-		Major:       int(major),
-		Minor:       int(minor),
+		Type:         DyskType(split[0]),
+		Name:         split[1],
+		sectorCount:  sectorCount,
+		AccountName:  split[3],
+		AccountKey:   split[4],
+		Path:         blobPath,
+		SnapshotTime: snapshotTime,
+		host:         split[6],
+		ip:           split[7],
+		LeaseId:      split[8],
+		Major:        int(major),
+		Minor:        int(minor),
 	}
 	if 1 == is_vhd {
 		d.Vhd = true
 	}
+	if len(split) > minFields {
+		setExtendedFields(&d, split[minFields:])
+	}
 	return &d, nil
 }
 
+// Joins a split dysk response back with the account key, lease, SAS token
+// and segments (carry lease ids) masked so it can be included in errors
+func redactResponse(split []string) string {
+	return redactFields(split, 4, 8, 13, 22)
+}
+
+// Joins split back with the fields at indices masked
+func redactFields(split []string, indices ...int) string {
+	redacted := make([]string, len(split))
+	copy(redacted, split)
+	for _, idx := range indices {
+		if idx < len(redacted) {
+			redacted[idx] = redact(redacted[idx])
+		}
+	}
+	return strings.Join(redacted, "\n")
+}
+
+// s masked, empty values stay empty so an unleased dysk still reads as one
+func redact(s string) string {
+	if 0 == len(s) {
+		return s
+	}
+	return "<redacted>"
+}
+
+// Path as sent to the kernel. Snapshot mounts carry the snapshot as a query
+// parameter so the module's requests target the snapshot
+func kernelPath(d *Dysk) string {
+	if 0 == len(d.SnapshotTime) {
+		return d.Path
+	}
+	return d.Path + "?snapshot=" + url.QueryEscape(d.SnapshotTime)
+}
+
+// Reverse of kernelPath
+func splitKernelPath(p string) (blobPath string, snapshotTime string) {
+	idx := strings.Index(p, "?snapshot=")
+	if idx < 0 {
+		return p, ""
+	}
+	snapshotTime, err := url.QueryUnescape(p[idx+len("?snapshot="):])
+	if nil != err {
+		return p, ""
+	}
+	return p[:idx], snapshotTime
+}
+
+// reads and checks the footer of a vhd dysk's blob
+func (c *dyskclient) verifyVhdFooter(ctx context.Context, d *Dysk, pageBlob blobRef, getProps *storage.GetBlobPropertiesOptions) error {
+	footer, err := c.readVhdFooter(ctx, pageBlob, &storage.GetBlobOptions{Snapshot: getProps.Snapshot})
+	if nil != err {
+		return fmt.Errorf("Failed to read vhd footer of %s: %w", d.Path, err)
+	}
+	if err := isValidVhdFooter(footer); nil != err {
+		return fmt.Errorf("Blob at %s: %w", d.Path, err)
+	}
+	return nil
+}
+
+// Properties options for d's page blob, targeting the snapshot if any.
+// Leases don't apply to snapshots
+func blobPropertiesOptions(d *Dysk) (*storage.GetBlobPropertiesOptions, error) {
+	if 0 == len(d.SnapshotTime) {
+		return &storage.GetBlobPropertiesOptions{LeaseID: d.LeaseId}, nil
+	}
+
+	snapshot, err := time.Parse(time.RFC3339Nano, d.SnapshotTime)
+	if nil != err {
+		return nil, fmt.Errorf("Invalid snapshot time:%s. Error:%s", d.SnapshotTime, err.Error())
+	}
+	return &storage.GetBlobPropertiesOptions{Snapshot: &snapshot}, nil
+}
+
 // Dysk as string
 func dysk2string(d *Dysk) string {
 	//type-devicename-sectorcount-accountname-accountkey-path-host-ip-lease-vhd
@@ -483,23 +2014,141 @@ func dysk2string(d *Dysk) string {
 	if d.Vhd {
 		is_vhd = 1
 	}
-	out := fmt.Sprintf(format, d.Type, d.Name, d.sectorCount, d.AccountName, d.AccountKey, d.Path, d.host, d.ip, d.LeaseId, is_vhd)
+	out := fmt.Sprintf(format, d.Type, d.Name, d.sectorCount, d.AccountName, d.AccountKey, kernelPath(d), d.host, d.ip, d.LeaseId, is_vhd)
+	out += strings.Join(extendedFields(d), "\n") + "\n"
 	return out
 }
 
-// string as buffer with the correct padding
-func bufferize(s string) []byte {
+// Fields appended after is_vhd. Modules that predate them stop parsing at
+// is_vhd and ignore the rest, so new fields must only ever be appended
+// authmode-sastoken-sectorsize-ipfamily-readaheadkb-queuedepth-cachemode-leased-vhdtype-layout-segments
+func extendedFields(d *Dysk) []string {
+	authMode := authSharedKey
+	if 0 < len(d.SASToken) {
+		authMode = authSAS
+	}
+	return []string{authMode, d.SASToken, strconv.Itoa(d.SectorSize), ipFamily(d.ip), strconv.Itoa(d.ReadAheadKB), strconv.Itoa(d.QueueDepth), string(d.CacheMode), leasedField(d), vhdTypeField(d), layoutField(d), segmentsField(d)}
+}
+
+// "1" if requests carry d's lease, "0" for unleased R dysks (no lease header is sent)
+func leasedField(d *Dysk) string {
+	if 0 < len(d.LeaseId) {
+		return "1"
+	}
+	return "0"
+}
+
+// empty for single blob dysks
+func layoutField(d *Dysk) string {
+	if !isMultiBlob(d) {
+		return ""
+	}
+	return string(d.Layout)
+}
+
+// vhd subtype, empty for non vhd dysks
+func vhdTypeField(d *Dysk) string {
+	if !d.Vhd {
+		return ""
+	}
+	if 0 == len(d.VhdType) {
+		return string(VhdFixed)
+	}
+	return string(d.VhdType)
+}
+
+// Reads back the fields written by extendedFields. Missing fields keep
+// their zero value
+func setExtendedFields(d *Dysk, fields []string) {
+	if 1 < len(fields) && authSAS == fields[0] {
+		d.SASToken = fields[1]
+	}
+	if 2 < len(fields) {
+		d.SectorSize, _ = strconv.Atoi(fields[2])
+	}
+	if 5 < len(fields) {
+		d.ReadAheadKB, _ = strconv.Atoi(fields[4])
+		d.QueueDepth, _ = strconv.Atoi(fields[5])
+	}
+	if 6 < len(fields) {
+		d.CacheMode = CacheMode(fields[6])
+	}
+	if 8 < len(fields) && 0 < len(fields[8]) {
+		d.VhdType = VhdType(fields[8])
+	}
+	if 10 < len(fields) {
+		setSegments(d, fields[9], fields[10])
+	}
+}
+
+// Issues IOCTLs, tests replace it with a fake module
+var ioctl = sysIoctl
+
+// Issues an IOCTL against fd, retrying when interrupted by a signal. Returns
+// the length of the reply, the module writes it over the start of the
+// request without a NUL so only buffer[:n] is the reply
+func sysIoctl(fd uintptr, cmd uintptr, buffer []byte) (int, syscall.Errno) {
+	var r1 uintptr
+	var e syscall.Errno
+	for attempt := 0; attempt <= IOCTL_EINTR_RETRIES; attempt++ {
+		r1, _, e = syscall.Syscall(syscall.SYS_IOCTL, fd, cmd, uintptr(unsafe.Pointer(&buffer[0])))
+		if syscall.EINTR != e {
+			break
+		}
+	}
+	if 0 != e || uintptr(len(buffer)) < r1 {
+		return 0, e
+	}
+	return int(r1), e
+}
+
+// Requests are one line per field and a NUL terminator. List is the
+// exception, it takes "-" alone
+func frameRequest(fields ...string) string {
+	return strings.Join(fields, "\n") + "\n\x00"
+}
+
+// request naming a single dysk (get, unmount, ping, stats)
+func frameName(name string) string {
+	return frameRequest(name)
+}
+
+// s padded with NULs to size bytes, the IOCTL buffer. Requests that do not
+// fit with at least one NUL after them fail with ErrRequestTooLarge
+func bufferize(s string, size int) ([]byte, error) {
 	var b bytes.Buffer
 	messageBytes := []byte(s)
-	pad := make([]byte, IOCTL_IN_OUT_MAX-len(messageBytes))
+	if len(messageBytes) >= size {
+		return nil, fmt.Errorf("Request is %d bytes, module accepts at most %d: %w", len(messageBytes), size-1, ErrRequestTooLarge)
+	}
+	pad := make([]byte, size-len(messageBytes))
 
 	b.Write(messageBytes)
 	b.Write(pad)
 
-	return b.Bytes()
+	return b.Bytes(), nil
 }
-func (c *dyskclient) openDeviceFile() error {
-	f, err := os.Open(deviceFile)
-	c.f = f
-	return err
+
+func (c *dyskclient) openFile() (*os.File, error) {
+	f, err := os.Open(c.deviceFile)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s does not exist, the dysk kernel module is probably not loaded (try modprobe dysk): %w", c.deviceFile, ErrModuleNotLoaded)
+	}
+	if os.IsPermission(err) {
+		return nil, fmt.Errorf("Permission denied opening %s, run as root or with CAP_SYS_ADMIN: %w", c.deviceFile, ErrPermissionDenied)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if nil != err {
+		f.Close()
+		return nil, err
+	}
+	if 0 == st.Mode()&os.ModeCharDevice {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a character device (mode %s)", c.deviceFile, st.Mode())
+	}
+	return f, nil
 }
@@ -0,0 +1,514 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentList(t *testing.T) {
+	const dyskCount = 20
+	const callers = 50
+
+	var dysks []*Dysk
+	for i := 0; i < dyskCount; i++ {
+		dysks = append(dysks, testDysk(fmt.Sprintf("dysk%02d", i), i))
+	}
+	c := withFakeModule(t, newFakeModule(dysks...))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listed, err := c.List()
+			if nil != err {
+				errs <- err
+				return
+			}
+			if dyskCount != len(listed) {
+				errs <- fmt.Errorf("listed %d dysks, expected %d", len(listed), dyskCount)
+				return
+			}
+			for idx, d := range listed {
+				expected := dysks[idx]
+				if expected.Name != d.Name || expected.Path != d.Path || expected.LeaseId != d.LeaseId || expected.Minor != d.Minor {
+					errs <- fmt.Errorf("dysk %d is %s (%s, %s, minor %d), expected %s", idx, d.Name, d.Path, d.LeaseId, d.Minor, expected.Name)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCacheModeRoundTrip(t *testing.T) {
+	cases := []struct {
+		dyskType  DyskType
+		cacheMode CacheMode
+	}{
+		{ReadOnly, CacheModeNone},
+		{ReadOnly, CacheModeRead},
+		{ReadWrite, CacheModeNone},
+		{ReadWrite, CacheModeWriteThrough},
+		{ReadWrite, CacheModeWriteBack},
+	}
+	for _, tc := range cases {
+		d := testDysk("dysk01", 0)
+		d.Type = tc.dyskType
+		d.CacheMode = tc.cacheMode
+		if err := isValidCacheMode(d); nil != err {
+			t.Errorf("%s/%s: %s", tc.dyskType, tc.cacheMode, err)
+			continue
+		}
+
+		parsed, err := string2dysk(getResponse(d))
+		if nil != err {
+			t.Errorf("%s/%s: %s", tc.dyskType, tc.cacheMode, err)
+			continue
+		}
+		if tc.cacheMode != parsed.CacheMode {
+			t.Errorf("%s/%s: parsed cache mode %q", tc.dyskType, tc.cacheMode, parsed.CacheMode)
+		}
+	}
+}
+
+func TestBufferize(t *testing.T) {
+	const size = 16
+
+	cases := []struct {
+		name    string
+		request string
+		err     error
+	}{
+		{"short", "get\n\x00", nil},
+		{"exact fit", "0123456789abcd\n", nil},
+		{"one byte over", "0123456789abcde\n", ErrRequestTooLarge},
+		{"embedded NUL", "dysk\x00name\n", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buffer, err := bufferize(tc.request, size)
+			if nil != tc.err {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected %v got %v", tc.err, err)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+			if size != len(buffer) {
+				t.Fatalf("expected a %d bytes buffer got %d", size, len(buffer))
+			}
+			if !bytes.HasPrefix(buffer, []byte(tc.request)) {
+				t.Fatalf("request not at the head of the buffer: %q", buffer)
+			}
+			if pad := buffer[len(tc.request):]; 0 == len(pad) || 0 != len(bytes.Trim(pad, "\x00")) {
+				t.Fatalf("expected NUL padding after the request got %q", pad)
+			}
+		})
+	}
+}
+
+func TestParseResponsePadding(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	padded, err := bufferize("OK\n"+getResponse(d), IOCTL_IN_OUT_MAX)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		buffer   []byte
+		response string
+	}{
+		{"padded", padded, getResponse(d)},
+		{"exact fit", []byte("OK\nfull"), "full"},
+		{"embedded NUL", []byte("ERR\nno such dysk\x00stale bytes\x00\x00"), "no such dysk"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := parseResponse(tc.buffer)
+			if nil != err {
+				t.Fatal(err)
+			}
+			if tc.response != res.response {
+				t.Fatalf("expected response %q got %q", tc.response, res.response)
+			}
+		})
+	}
+
+	res, err := parseResponse(padded)
+	if nil != err {
+		t.Fatal(err)
+	}
+	parsed, err := string2dysk(res.response)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if d.Name != parsed.Name || d.Path != parsed.Path || d.LeaseId != parsed.LeaseId {
+		t.Fatalf("expected clean fields %q %q %q got %q %q %q", d.Name, d.Path, d.LeaseId, parsed.Name, parsed.Path, parsed.LeaseId)
+	}
+}
+
+// A stub proxy answers every request itself, the storage host is never reached
+func TestWithProxy(t *testing.T) {
+	var lock sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		proxied = append(proxied, r.URL.String())
+		lock.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer proxy.Close()
+
+	c := CreateClient("dyskaccount", "a2V5", WithProxy(proxy.URL)).(*dyskclient)
+	httpClient, err := c.blobHTTPClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// never resolves, only the proxy can answer
+	const target = "http://dyskaccount.blob.dysk.invalid/dysks/dysk01"
+	res, err := httpClient.Get(target)
+	if nil != err {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if http.StatusNotFound != res.StatusCode {
+		t.Fatalf("expected the proxy's 404 got %d", res.StatusCode)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if 1 != len(proxied) || target != proxied[0] {
+		t.Fatalf("expected the proxy to see %s got %v", target, proxied)
+	}
+}
+
+func TestWithProxyInvalidURL(t *testing.T) {
+	c := CreateClient("dyskaccount", "a2V5", WithProxy("://nohost")).(*dyskclient)
+	if _, err := c.blobHTTPClient(); nil == err {
+		t.Fatal("expected an invalid proxy url to fail")
+	}
+}
+
+// ctx ends the wait, not the call, which only the http timeout ends
+func TestDoWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	finished := make(chan struct{})
+	start := time.Now()
+	err := doWithContext(ctx, func() error {
+		defer close(finished)
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded got %v", err)
+	}
+	if waited := time.Since(start); 100*time.Millisecond < waited {
+		t.Fatalf("expected doWithContext to return when ctx is done, it waited %v", waited)
+	}
+	<-finished
+
+	c := CreateClient("dyskaccount", "a2V5").(*dyskclient)
+	httpClient, err := c.blobHTTPClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if DEFAULT_HTTP_TIMEOUT != httpClient.Timeout {
+		t.Fatalf("expected blob requests to be bounded to %v got %v", DEFAULT_HTTP_TIMEOUT, httpClient.Timeout)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// WithHTTPClient, WithHTTPTimeout and WithProxy compose whatever their order
+func TestHTTPOptionsCompose(t *testing.T) {
+	const proxyURL = "http://proxy.dysk.invalid:3128"
+	base := &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSHandshakeTimeout: 3 * time.Second},
+	}
+	orders := map[string][]ClientOption{
+		"client-timeout-proxy": {WithHTTPClient(base), WithHTTPTimeout(5 * time.Second), WithProxy(proxyURL)},
+		"proxy-timeout-client": {WithProxy(proxyURL), WithHTTPTimeout(5 * time.Second), WithHTTPClient(base)},
+		"timeout-client-proxy": {WithHTTPTimeout(5 * time.Second), WithHTTPClient(base), WithProxy(proxyURL)},
+	}
+	for name, options := range orders {
+		t.Run(name, func(t *testing.T) {
+			c := CreateClient("dyskaccount", "a2V5", options...).(*dyskclient)
+			httpClient, err := c.blobHTTPClient()
+			if nil != err {
+				t.Fatal(err)
+			}
+			if 5*time.Second != httpClient.Timeout {
+				t.Fatalf("expected the 5s timeout got %v", httpClient.Timeout)
+			}
+			transport, ok := httpClient.Transport.(*http.Transport)
+			if !ok {
+				t.Fatalf("expected an *http.Transport got %T", httpClient.Transport)
+			}
+			if 3*time.Second != transport.TLSHandshakeTimeout {
+				t.Fatalf("expected the caller's TLS handshake timeout got %v", transport.TLSHandshakeTimeout)
+			}
+			req, _ := http.NewRequest("GET", "https://dyskaccount.blob.core.windows.net/dysks/dysk01", nil)
+			proxy, err := transport.Proxy(req)
+			if nil != err || nil == proxy || proxyURL != proxy.String() {
+				t.Fatalf("expected proxy %s got %v (%v)", proxyURL, proxy, err)
+			}
+		})
+	}
+
+	// the caller's client is never modified
+	if time.Minute != base.Timeout || nil != base.Transport.(*http.Transport).Proxy {
+		t.Fatal("expected the WithHTTPClient client to be left as is")
+	}
+}
+
+func TestWithProxyCustomTransport(t *testing.T) {
+	custom := &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("not used")
+	})}
+	c := CreateClient("dyskaccount", "a2V5", WithHTTPClient(custom), WithProxy("http://proxy.dysk.invalid:3128")).(*dyskclient)
+	if _, err := c.blobHTTPClient(); nil == err {
+		t.Fatal("expected a proxy on a custom RoundTripper to fail")
+	}
+
+	// without a proxy the custom transport is used as is
+	c = CreateClient("dyskaccount", "a2V5", WithHTTPClient(custom), WithHTTPTimeout(time.Second)).(*dyskclient)
+	httpClient, err := c.blobHTTPClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := httpClient.Transport.(roundTripperFunc); !ok || time.Second != httpClient.Timeout {
+		t.Fatalf("expected the custom transport with a 1s timeout got %T %v", httpClient.Transport, httpClient.Timeout)
+	}
+}
+
+// The last dysk is listed whether or not the module ends the list with a new line
+func TestListTrailingNewLine(t *testing.T) {
+	for _, trailing := range []bool{true, false} {
+		for _, dyskCount := range []int{0, 1, 3} {
+			t.Run(fmt.Sprintf("trailing=%v/dysks=%d", trailing, dyskCount), func(t *testing.T) {
+				var dysks []*Dysk
+				for i := 0; i < dyskCount; i++ {
+					dysks = append(dysks, testDysk(fmt.Sprintf("dysk%02d", i), i))
+				}
+				m := newFakeModule(dysks...)
+				m.noTrailingNewLine = !trailing
+				c := withFakeModule(t, m)
+
+				raw, err := c.RawList()
+				if nil != err {
+					t.Fatal(err)
+				}
+				if 0 < dyskCount && trailing != strings.HasSuffix(raw, "\n") {
+					t.Fatalf("fake module response %q does not match trailing=%v", raw, trailing)
+				}
+
+				listed, err := c.List()
+				if nil != err {
+					t.Fatal(err)
+				}
+				if dyskCount != len(listed) {
+					t.Fatalf("expected %d dysks got %d", dyskCount, len(listed))
+				}
+				for i, d := range listed {
+					if dysks[i].Name != d.Name {
+						t.Fatalf("expected %s at %d got %s", dysks[i].Name, i, d.Name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFrameRequest(t *testing.T) {
+	cases := []struct {
+		name   string
+		framed string
+		bytes  []byte
+	}{
+		{"name", frameName("dysk01"), []byte("dysk01\n\x00")},
+		{"fields", frameRequest("dysk01", "4096"), []byte("dysk01\n4096\n\x00")},
+		{"empty field", frameRequest("dysk01", "", "lease"), []byte("dysk01\n\nlease\n\x00")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if !bytes.Equal(tc.bytes, []byte(tc.framed)) {
+				t.Fatalf("expected %q got %q", tc.bytes, tc.framed)
+			}
+		})
+	}
+}
+
+func TestRedactResponse(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	d.SASToken = "sv=2020-08-04&sig=secret"
+	d.Paths = []string{"/dysks/dysk01", "/dysks/dysk01b"}
+	d.LeaseIds = []string{"lease-dysk01", "lease-dysk01b"}
+	d.segmentSectors = []uint64{1024, 1024}
+
+	split := strings.Split(getResponse(d), "\n")
+	redacted := redactResponse(split)
+	for _, secret := range []string{d.AccountKey, d.LeaseId, "lease-dysk01b", "sig=secret"} {
+		if strings.Contains(redacted, secret) {
+			t.Fatalf("%q leaked into %q", secret, redacted)
+		}
+	}
+	if !strings.Contains(redacted, d.Name) || !strings.Contains(redacted, d.Path) {
+		t.Fatalf("expected the rest of the response in %q", redacted)
+	}
+}
+
+func TestStartLeaseRenewal(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	backend := newFakeBlobBackend(0)
+	backend.addPageBlob(d.Path, BYTES_PER_GB, d.LeaseId)
+	// no key of its own, renewals use the dysk's credentials
+	c := CreateClient("", "", WithLogger(NopLogger), withBlobBackend(backend))
+
+	errs := make(chan error, 1)
+	stop, err := c.StartLeaseRenewal(d, time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	stop()
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected renewal error %v", err)
+	default:
+	}
+
+	other := *d
+	other.LeaseId = "lease-other"
+	if _, err := c.StartLeaseRenewal(&other, time.Millisecond, nil); nil == err {
+		t.Fatal("expected renewing someone else's lease to fail")
+	}
+}
+
+func TestEmulatorRejectsMounts(t *testing.T) {
+	c := CreateClient("", "", WithEmulator(), WithLogger(NopLogger))
+	d := testDysk("dysk01", 1)
+	if err := c.DryRunMount(d); !errors.Is(err, ErrEmulatorMount) {
+		t.Fatalf("expected ErrEmulatorMount got %v", err)
+	}
+	if err := c.Mount(d); !errors.Is(err, ErrEmulatorMount) {
+		t.Fatalf("expected ErrEmulatorMount got %v", err)
+	}
+}
+
+// The module writes its reply over the start of the request without a NUL,
+// a short ERR reply must not pick up the credentials after it
+func TestMountShortErrorReply(t *testing.T) {
+	backend := newFakeBlobBackend(0)
+	backend.addPageBlob("/dysks/dysk01", BYTES_PER_GB, "lease-dysk01")
+	m := newFakeModule()
+	m.mountResponse = "ERR\nbusy\n"
+	c := withFakeModule(t, m, withBlobBackend(backend))
+	c.storageAccountKey = "a2V5"
+
+	err := c.Mount(testDysk("dysk01", 0))
+	var moduleErr *ModuleResponseError
+	if !errors.As(err, &moduleErr) {
+		t.Fatalf("expected a ModuleResponseError got %v", err)
+	}
+	if "busy\n" != moduleErr.Response {
+		t.Fatalf("expected the reply alone got %q", moduleErr.Response)
+	}
+	for _, secret := range []string{"a2V5", "lease-dysk01"} {
+		if strings.Contains(err.Error(), secret) {
+			t.Fatalf("error leaks %s: %q", secret, err.Error())
+		}
+	}
+}
+
+func TestMountWithResult(t *testing.T) {
+	backend := newFakeBlobBackend(0)
+	backend.addPageBlob("/dysks/dysk01", BYTES_PER_GB, "lease-dysk01")
+	mounted := testDysk("dysk01", 3)
+	m := newFakeModule()
+	m.mountResponse = "OK\n" + getResponse(mounted)
+	c := withFakeModule(t, m, withBlobBackend(backend))
+	c.storageAccountKey = "a2V5"
+
+	d := testDysk("dysk01", 0)
+	res, err := c.MountWithResult(context.Background(), d, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := MountResult{Major: 250, Minor: 3, DevicePath: devPath + "/dysk01", SizeBytes: BYTES_PER_GB}
+	if expected != *res {
+		t.Fatalf("expected %+v got %+v", expected, *res)
+	}
+	if 3 != d.Minor {
+		t.Fatalf("expected the dysk to be updated in place got minor %d", d.Minor)
+	}
+}
+
+// a page blob created for a mount that fails is released and deleted
+func TestMountCreateIfMissingCleanup(t *testing.T) {
+	backend := newFakeBlobBackend(0)
+	m := newFakeModule()
+	m.mountResponse = "ERR\nbusy\n"
+	c := withFakeModule(t, m, withBlobBackend(backend))
+	c.storageAccountKey = "a2V5"
+
+	d := testDysk("dysk01", 0)
+	d.LeaseId = ""
+	d.SizeBytes = BYTES_PER_GB
+	err := c.MountWithOptions(context.Background(), d, &MountOptions{CreateIfMissing: true})
+	var moduleErr *ModuleResponseError
+	if !errors.As(err, &moduleErr) {
+		t.Fatalf("expected the module's error got %v", err)
+	}
+	if !strings.Contains(err.Error(), "was deleted") {
+		t.Fatalf("expected the error to say the blob was deleted got %v", err)
+	}
+	if nil != backend.blob("/dysks/dysk01") {
+		t.Fatal("page blob created for the failed mount was left behind")
+	}
+}
+
+// releasing a lease is retried like acquiring and renewing it
+func TestReleaseLeaseRetried(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	backend := newFakeBlobBackend(0)
+	backend.addPageBlob(d.Path, BYTES_PER_GB, d.LeaseId)
+	backend.busyReleases = 1
+	c := CreateClient("", "", WithLogger(NopLogger), withBlobBackend(backend), WithRetry(2, time.Millisecond)).(*dyskclient)
+
+	if err := c.releaseLease(context.Background(), d); nil != err {
+		t.Fatal(err)
+	}
+	if leaseId := backend.blob(d.Path).leaseId; 0 < len(leaseId) {
+		t.Fatalf("expected the lease to be released got %s", leaseId)
+	}
+}
@@ -3,29 +3,151 @@ package client
 import (
 	"fmt"
 	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rubiojr/go-vhd/vhd"
 )
 
-const ACCOUNT_NAME_LEN = 256
+const MIN_ACCOUNT_NAME_LEN = 3
+const MAX_ACCOUNT_NAME_LEN = 24
 const ACCOUNT_KEY_LEN = 128
 const DEVICE_NAME_LEN = 32
 const BLOB_PATH_LEN = 1024
 const HOST_LEN = 512
 const IP_LEN = 32
 const LEASE_ID_LEN = 64
+const INFINITE_LEASE = -1
+const MIN_LEASE_SECONDS = 15
+const MAX_LEASE_SECONDS = 60
+const SAS_TOKEN_LEN = 512
+const DEFAULT_SECTOR_SIZE = 512
+const MAX_SECTOR_SIZE = 4096
+const BYTES_PER_GB = 1024 * 1024 * 1024
+const PARALLEL_WORKERS = 8
+const MAX_READ_AHEAD_KB = 32768
+const MAX_PAGE_BLOB_BYTES = 8 * 1024 * BYTES_PER_GB
+const MAX_PUT_PAGE_BYTES = 4 * 1024 * 1024
+const MAX_PROBE_BYTES = 4 * 1024 * 1024
+const DEFAULT_DELEGATED_SAS_LIFETIME = 24 * time.Hour
+const DEFAULT_HTTP_TIMEOUT = 5 * time.Minute
+const MIN_QUEUE_DEPTH = 4
+const MAX_QUEUE_DEPTH = 4096
+
+var lower_numbers_alpha = regexp.MustCompile(`^[a-z0-9]+$`).MatchString
 
-func isValidDeviceName(deviceName string) error {
+// ValidateDeviceName checks a dysk device name as used by lookups (Get,
+// Unmount..). It accepts any name a dysk could have been mounted with before:
+// up to DEVICE_NAME_LEN chars, no \ / . new line or NUL. Mount is stricter,
+// see isValidMountName
+func ValidateDeviceName(deviceName string) error {
 	if 0 == len(deviceName) {
-		return fmt.Errorf("device name is empty")
+		return fmt.Errorf("device name is empty: %w", ErrInvalidDeviceName)
 	}
 
 	if len(deviceName) > DEVICE_NAME_LEN {
-		return fmt.Errorf("Device name %s is longer than %d chars", deviceName, DEVICE_NAME_LEN)
+		return fmt.Errorf("Device name %s is longer than %d chars: %w", deviceName, DEVICE_NAME_LEN, ErrInvalidDeviceName)
+	}
+
+	if strings.ContainsAny(deviceName, "\\/.\n\x00") {
+		return fmt.Errorf("Device name:%q is invalid (no \\ / . new line or NUL): %w", deviceName, ErrInvalidDeviceName)
+	}
+	return nil
+}
+
+// Names are case sensitive, the kernel module and /dev match them exactly.
+// New dysks must be named with lower case letters and numbers only so two
+// dysks never differ by case alone
+func isValidMountName(deviceName string) error {
+	if err := ValidateDeviceName(deviceName); nil != err {
+		return err
+	}
+	if !lower_numbers_alpha(deviceName) {
+		return fmt.Errorf("Device name:%s is invalid, new dysks are named with lower case letters and numbers only: %w", deviceName, ErrInvalidDeviceName)
 	}
+	return nil
+}
+
+// storage account names as Azure accepts them, caught here rather than as a
+// failed DNS lookup
+func isValidAccountName(account string) error {
+	if MIN_ACCOUNT_NAME_LEN > len(account) || MAX_ACCOUNT_NAME_LEN < len(account) || !lower_numbers_alpha(account) {
+		return fmt.Errorf("Invalid Account name:%q. Must be %d to %d lower case letters and digits", account, MIN_ACCOUNT_NAME_LEN, MAX_ACCOUNT_NAME_LEN)
+	}
+	return nil
+}
+
+// lease duration in seconds as Azure accepts it
+func isValidLeaseDuration(seconds int) error {
+	if INFINITE_LEASE == seconds || (MIN_LEASE_SECONDS <= seconds && MAX_LEASE_SECONDS >= seconds) {
+		return nil
+	}
+	return fmt.Errorf("Invalid lease duration %d. Must be %d (infinite) or %d to %d seconds", seconds, INFINITE_LEASE, MIN_LEASE_SECONDS, MAX_LEASE_SECONDS)
+}
 
-	numbers_alpha := regexp.MustCompile(`^[A-Za-z0-9.]+$`).MatchString
+func isValidCacheMode(d *Dysk) error {
+	switch d.CacheMode {
+	case CacheModeNone:
+		return nil
+	case CacheModeRead:
+		if d.IsReadOnly() {
+			return nil
+		}
+	case CacheModeWriteThrough, CacheModeWriteBack:
+		if d.IsReadWrite() {
+			return nil
+		}
+	default:
+		return fmt.Errorf("Invalid cache mode:%s. Must be none, read, writethrough or writeback", d.CacheMode)
+	}
+	return fmt.Errorf("Invalid cache mode:%s for dysk type %s. R dysks can use none or read, RW dysks none, writethrough or writeback", d.CacheMode, d.Type)
+}
+
+// /container/blob
+func isValidBlobPath(blobPath string) error {
+	if 0 == len(blobPath) {
+		return fmt.Errorf("Invalid path. Path is empty, expected /container/blob")
+	}
+	if !strings.HasPrefix(blobPath, "/") {
+		return fmt.Errorf("Invalid path:%s. Must start with /, expected /container/blob", blobPath)
+	}
+
+	segments := strings.Split(blobPath[1:], "/")
+	if 2 > len(segments) {
+		return fmt.Errorf("Invalid path:%s. Missing blob name, expected /container/blob", blobPath)
+	}
+	for _, segment := range segments {
+		if 0 == len(segment) {
+			return fmt.Errorf("Invalid path:%s. Must not contain empty segments (// or a trailing /)", blobPath)
+		}
+		if "." == segment || ".." == segment {
+			return fmt.Errorf("Invalid path:%s. Must not contain . or .. segments", blobPath)
+		}
+	}
+	return nil
+}
+
+// Azure page blobs are 512 byte aligned and at most 8TiB. A vhd must leave
+// at least one sector besides its footer
+func isValidPageBlobSize(sizeBytes uint64, is_vhd bool) error {
+	if 0 == sizeBytes {
+		return fmt.Errorf("Invalid page blob size. Must not be 0")
+	}
+	if MAX_PAGE_BLOB_BYTES < sizeBytes {
+		return fmt.Errorf("Invalid page blob size:%d bytes. Must be <= %d bytes (8TiB)", sizeBytes, uint64(MAX_PAGE_BLOB_BYTES))
+	}
+	if 0 != sizeBytes%DEFAULT_SECTOR_SIZE {
+		return fmt.Errorf("Invalid page blob size:%d bytes. Must be a multiple of %d", sizeBytes, DEFAULT_SECTOR_SIZE)
+	}
+	if is_vhd && sizeBytes <= vhd.VHD_HEADER_SIZE {
+		return fmt.Errorf("Invalid page blob size:%d bytes. A vhd needs more than %d bytes for its footer", sizeBytes, vhd.VHD_HEADER_SIZE)
+	}
+	return nil
+}
 
-	if !numbers_alpha(deviceName) {
-		return fmt.Errorf("Device name:%s is invalid only alpha + numnbers")
+func isValidSectorSize(sectorSize int) error {
+	if sectorSize < DEFAULT_SECTOR_SIZE || sectorSize > MAX_SECTOR_SIZE || 0 != sectorSize&(sectorSize-1) {
+		return fmt.Errorf("Invalid sector size:%d. Must be a power of two between %d and %d", sectorSize, DEFAULT_SECTOR_SIZE, MAX_SECTOR_SIZE)
 	}
 	return nil
 }
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNameCase(t *testing.T) {
+	cases := []struct {
+		name      string
+		mountable bool
+	}{
+		{"mydysk01", true},
+		{"MYDYSK01", false},
+		{"MyDysk01", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// lookups accept any case, dysks mounted before still resolve
+			if err := ValidateDeviceName(tc.name); nil != err {
+				t.Fatalf("expected %s to be a valid lookup name got %v", tc.name, err)
+			}
+
+			err := isValidMountName(tc.name)
+			if tc.mountable && nil != err {
+				t.Fatalf("expected %s to be mountable got %v", tc.name, err)
+			}
+			if !tc.mountable && !errors.Is(err, ErrInvalidDeviceName) {
+				t.Fatalf("expected %s to be rejected for mount got %v", tc.name, err)
+			}
+		})
+	}
+}
+
+// lookups accept the names dysks were mounted with before, mounts only
+// lower case letters and numbers
+func TestNameChars(t *testing.T) {
+	cases := []struct {
+		name      string
+		lookup    bool
+		mountable bool
+	}{
+		{"dysk01", true, true},
+		{"old-dysk_01", true, false},
+		{"Old Dysk", true, false},
+		{"", false, false},
+		{strings.Repeat("a", DEVICE_NAME_LEN), true, true},
+		{strings.Repeat("a", DEVICE_NAME_LEN+1), false, false},
+		{"dysk/01", false, false},
+		{"dysk\\01", false, false},
+		{"dysk.01", false, false},
+		{"dysk\n01", false, false},
+		{"dysk\x0001", false, false},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%q", tc.name), func(t *testing.T) {
+			err := ValidateDeviceName(tc.name)
+			if tc.lookup && nil != err {
+				t.Fatalf("expected %q to be a valid lookup name got %v", tc.name, err)
+			}
+			if !tc.lookup && !errors.Is(err, ErrInvalidDeviceName) {
+				t.Fatalf("expected %q to be rejected for lookups got %v", tc.name, err)
+			}
+
+			err = isValidMountName(tc.name)
+			if tc.mountable && nil != err {
+				t.Fatalf("expected %q to be mountable got %v", tc.name, err)
+			}
+			if !tc.mountable && !errors.Is(err, ErrInvalidDeviceName) {
+				t.Fatalf("expected %q to be rejected for mount got %v", tc.name, err)
+			}
+		})
+	}
+}
+
+// Get matches the name the dysk was mounted with exactly
+func TestNameCaseLookup(t *testing.T) {
+	c := withFakeModule(t, newFakeModule(testDysk("mydysk01", 1), testDysk("OldDysk", 2)))
+
+	cases := []struct {
+		name  string
+		found bool
+	}{
+		{"mydysk01", true},
+		{"MYDYSK01", false},
+		{"MyDysk01", false},
+		{"OldDysk", true},
+		{"olddysk", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := c.Get(tc.name)
+			if tc.found {
+				if nil != err {
+					t.Fatal(err)
+				}
+				if tc.name != d.Name {
+					t.Fatalf("expected %s got %s", tc.name, d.Name)
+				}
+				return
+			}
+			if !errors.Is(err, ErrDyskNotFound) {
+				t.Fatalf("expected %s not to be found got %v", tc.name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// block device nodes created by udev
+const devPath = "/dev"
+
+// how often WaitForDevice checks for the device node
+const waitForDevicePollInterval = 100 * time.Millisecond
+
+// WaitForDevice waits until the block device node of a mounted dysk exists
+// (udev creates it asynchronously after Mount returns) and returns its path
+func (c *dyskclient) WaitForDevice(name string, timeout time.Duration) (string, error) {
+	d, err := c.Get(name)
+	if nil != err {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(waitForDevicePollInterval)
+	defer ticker.Stop()
+	for {
+		devicePath, err := deviceNode(d)
+		if nil == err {
+			return devicePath, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", fmt.Errorf("Timed out after %s waiting for device node of dysk %s (%d:%d). Error:%s", timeout, name, d.Major, d.Minor, err.Error())
+		}
+	}
+}
+
+// OpenDevice opens the block device node of a mounted dysk with os.OpenFile
+// flags (e.g. os.O_RDWR) for block I/O. Open is taken by the device file session
+func (c *dyskclient) OpenDevice(name string, flags int) (*os.File, error) {
+	d, err := c.Get(name)
+	if nil != err {
+		return nil, err
+	}
+
+	devicePath, err := deviceNode(d)
+	if nil != err {
+		return nil, fmt.Errorf("Device node of dysk %s (%d:%d) is missing. Error:%s", name, d.Major, d.Minor, err.Error())
+	}
+	return os.OpenFile(devicePath, flags, 0)
+}
+
+// path of d's block device node, checked against its major:minor
+func deviceNode(d *Dysk) (string, error) {
+	devicePath := path.Join(devPath, d.Name)
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(devicePath, &st); nil != err {
+		return "", &os.PathError{Op: "stat", Path: devicePath, Err: err}
+	}
+	if syscall.S_IFBLK != st.Mode&syscall.S_IFMT {
+		return "", fmt.Errorf("%s is not a block device", devicePath)
+	}
+
+	major, minor := splitDev(uint64(st.Rdev))
+	if d.Major != major || d.Minor != minor {
+		return "", fmt.Errorf("%s is device %d:%d, dysk %s is %d:%d", devicePath, major, minor, d.Name, d.Major, d.Minor)
+	}
+	return devicePath, nil
+}
+
+// glibc's gnu_dev_major/gnu_dev_minor
+func splitDev(dev uint64) (int, int) {
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000)
+	minor := (dev & 0xff) | ((dev >> 12) & 0xffffff00)
+	return int(major), int(minor)
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrContainerNotFound = errors.New("container not found")
+	ErrBlobNotFound      = errors.New("blob not found")
+	ErrNotPageBlob       = errors.New("blob is not a page blob")
+	ErrInvalidVhd        = errors.New("not a valid VHD")
+	ErrBlobMounted       = errors.New("blob is mounted as a dysk")
+	// Returned for RW mounts of a blob leased under another lease id,
+	// typically mounted RW by another host
+	ErrLeasedElsewhere   = errors.New("blob is leased elsewhere")
+	ErrInvalidDeviceName = errors.New("invalid device name")
+	ErrNameInUse         = errors.New("dysk name is in use")
+	ErrDyskNotFound      = errors.New("dysk not found")
+	// Returned by UnmountGraceful when I/O did not drain in time
+	ErrFlushTimeout     = errors.New("dysk did not flush in time")
+	ErrRequestTooLarge  = errors.New("request exceeds the ioctl buffer size")
+	ErrModuleNotLoaded  = errors.New("dysk kernel module not loaded")
+	ErrPermissionDenied = errors.New("permission denied on dysk device file")
+	// Returned when a feature needs a newer kernel module than the loaded one
+	ErrUnsupportedByModule = errors.New("unsupported by loaded module")
+	// Returned when mounting with a client created WithEmulator
+	ErrEmulatorMount = errors.New("dysks can not be mounted from a storage emulator")
+	// Returned when WithIOCTLBufferSize does not match the loaded module
+	ErrBufferSizeMismatch = errors.New("ioctl buffer size does not match the module's")
+	// Matches any ModuleResponseError via errors.Is
+	ErrModuleResponse = errors.New("kernel module returned an error")
+	// Matches any IOCTLError via errors.Is
+	ErrIOCTL = errors.New("ioctl failed")
+)
+
+// ModuleResponseError is returned when the kernel module rejects a command.
+// Response is the module's message as is. Besides ErrModuleResponse it
+// matches ErrDyskNotFound when the module has no dysk of the requested name
+// (get, unmount..)
+type ModuleResponseError struct {
+	Response string
+}
+
+// the module answers "device with name:<name> does not exists"
+const moduleNotFoundResponse = "does not exist"
+
+func (e *ModuleResponseError) Error() string {
+	return e.Response
+}
+
+func (e *ModuleResponseError) Is(target error) bool {
+	switch target {
+	case ErrModuleResponse:
+		return true
+	case ErrDyskNotFound:
+		return strings.Contains(e.Response, moduleNotFoundResponse)
+	}
+	return false
+}
+
+// IOCTLError is returned when the IOCTL syscall itself fails, before the
+// module had a say. errors.Is matches Errno, e.g. syscall.EAGAIN
+type IOCTLError struct {
+	Cmd   uintptr
+	Errno syscall.Errno
+}
+
+func (e *IOCTLError) Error() string {
+	return fmt.Sprintf("IOCTL %d failed: %s", e.Cmd, e.Errno.Error())
+}
+
+func (e *IOCTLError) Is(target error) bool {
+	return target == ErrIOCTL
+}
+
+func (e *IOCTLError) Unwrap() error {
+	return e.Errno
+}
+
+// Temporary is true for errnos worth retrying, e.g. EAGAIN
+func (e *IOCTLError) Temporary() bool {
+	return e.Errno.Temporary()
+}
@@ -0,0 +1,431 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// fakeModule answers IOCTLs the way the kernel module does for a fixed set
+// of mounted dysks
+type fakeModule struct {
+	lock  sync.Mutex
+	dysks map[string]*Dysk
+	// list order
+	names []string
+	// drops the new line after the last name of list responses
+	noTrailingNewLine bool
+	// answers the module info IOCTL, legacy modules (nil) fail it with ENOTTY
+	info *ModuleInfo
+	// reply to mount IOCTLs, mounts fail with ENOTTY if empty
+	mountResponse string
+}
+
+func newFakeModule(dysks ...*Dysk) *fakeModule {
+	m := &fakeModule{dysks: make(map[string]*Dysk)}
+	for _, d := range dysks {
+		m.dysks[d.Name] = d
+		m.names = append(m.names, d.Name)
+	}
+	return m
+}
+
+func (m *fakeModule) ioctl(fd uintptr, cmd uintptr, buffer []byte) (int, syscall.Errno) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	request := string(buffer)
+	if end := strings.IndexByte(request, 0); 0 <= end {
+		request = request[:end]
+	}
+	fields := strings.Split(request, "\n")
+
+	var response string
+	switch cmd {
+	case IOCTLISTDYYSKS:
+		response = "OK\n" + strings.Join(m.names, "\n")
+		if !m.noTrailingNewLine && 0 < len(m.names) {
+			response += "\n"
+		}
+	case IOCTGETDYSK:
+		d, ok := m.dysks[fields[0]]
+		if !ok {
+			response = fmt.Sprintf("ERR\nFailed to get dysk, device with name:%s does not exists", fields[0])
+			break
+		}
+		response = "OK\n" + getResponse(d)
+	case IOCTLMODULEINFO:
+		if nil == m.info {
+			return 0, syscall.ENOTTY
+		}
+		response = fmt.Sprintf("OK\n%s\n%d\n%d\n", m.info.Version, m.info.Capabilities, m.info.BufferSize)
+	case IOCTLMOUNTDYSK:
+		if 0 == len(m.mountResponse) {
+			return 0, syscall.ENOTTY
+		}
+		response = m.mountResponse
+	default:
+		return 0, syscall.ENOTTY
+	}
+
+	// like the module: the reply overwrites the start of the request, no NUL
+	return copy(buffer, response), 0
+}
+
+// installs m as the kernel module until the test ends and returns a client
+// talking to it
+func withFakeModule(tb testing.TB, m *fakeModule, opts ...ClientOption) *dyskclient {
+	ioctl = m.ioctl
+	tb.Cleanup(func() {
+		ioctl = sysIoctl
+	})
+
+	opts = append([]ClientOption{WithDeviceFile("/dev/null"), WithLogger(NopLogger)}, opts...)
+	return CreateClient("dyskaccount", "", opts...).(*dyskclient)
+}
+
+// d as the module's get response (without the status line)
+// type-devicename-sectorcount-accountname-accountkey-path-host-ip-lease-major-minor-vhd
+// then the extended fields
+func getResponse(d *Dysk) string {
+	is_vhd := 0
+	if d.Vhd {
+		is_vhd = 1
+	}
+	out := fmt.Sprintf("%s\n%s\n%d\n%s\n%s\n%s\n%s\n%s\n%s\n%d\n%d\n%d\n", d.Type, d.Name, d.sectorCount, d.AccountName, d.AccountKey, kernelPath(d), d.host, d.ip, d.LeaseId, d.Major, d.Minor, is_vhd)
+	return out + strings.Join(extendedFields(d), "\n") + "\n"
+}
+
+// a mounted RW dysk, every field derived from name so responses can be
+// matched to requests
+func testDysk(name string, minor int) *Dysk {
+	return &Dysk{
+		Type:        ReadWrite,
+		Name:        name,
+		sectorCount: 2048,
+		AccountName: "dyskaccount",
+		AccountKey:  "a2V5",
+		Path:        "/dysks/" + name,
+		host:        "dyskaccount.blob.core.windows.net",
+		ip:          "10.0.0.1",
+		LeaseId:     "lease-" + name,
+		Major:       250,
+		Minor:       minor,
+		SectorSize:  DEFAULT_SECTOR_SIZE,
+	}
+}
+
+// fakeBlobBackend is an in memory blob service, plugged in with
+// withBlobBackend. Every call that reaches Azure takes latency
+type fakeBlobBackend struct {
+	latency time.Duration
+	lock    sync.Mutex
+	// existing containers and blobs by /container/blob
+	containers map[string]bool
+	blobs      map[string]*fakeStoredBlob
+	// the next lostWrites WriteRange calls succeed without storing anything
+	lostWrites int
+	// the next lostLeases AcquireLease calls take the lease then fail with 500
+	lostLeases int
+	// the next busyReleases ReleaseLease calls fail with 503
+	busyReleases int
+}
+
+type fakeStoredBlob struct {
+	props    storage.BlobProperties
+	metadata storage.BlobMetadata
+	// written ranges by start offset, unwritten pages read as zeros
+	pages   map[uint64][]byte
+	leaseId string
+}
+
+func newFakeBlobBackend(latency time.Duration) *fakeBlobBackend {
+	return &fakeBlobBackend{
+		latency:    latency,
+		containers: make(map[string]bool),
+		blobs:      make(map[string]*fakeStoredBlob),
+	}
+}
+
+// adds a page blob leased with leaseId, and its container
+func (b *fakeBlobBackend) addPageBlob(blobPath string, sizeBytes int64, leaseId string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	container, _ := blobPathParts(blobPath)
+	b.containers[container] = true
+	b.blobs[blobPath] = &fakeStoredBlob{
+		props: storage.BlobProperties{
+			BlobType:      storage.BlobTypePage,
+			ContentLength: sizeBytes,
+			LeaseStatus:   "locked",
+			LeaseState:    leaseStateLeased,
+			LeaseDuration: "infinite",
+		},
+		metadata: storage.BlobMetadata{},
+		pages:    make(map[uint64][]byte),
+		leaseId:  leaseId,
+	}
+}
+
+// the stored blob at blobPath, nil if there is none
+func (b *fakeBlobBackend) blob(blobPath string) *fakeStoredBlob {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.blobs[blobPath]
+}
+
+func (b *fakeBlobBackend) call() {
+	time.Sleep(b.latency)
+}
+
+func (b *fakeBlobBackend) GetContainerReference(name string) blobContainer {
+	return &fakeContainer{backend: b, name: name, metadata: map[string]string{}}
+}
+
+func fakeAzureError(statusCode int, code string) error {
+	return storage.AzureStorageServiceError{StatusCode: statusCode, Code: code}
+}
+
+type fakeContainer struct {
+	backend  *fakeBlobBackend
+	name     string
+	metadata map[string]string
+}
+
+func (fc *fakeContainer) Exists() (bool, error) {
+	fc.backend.call()
+	fc.backend.lock.Lock()
+	defer fc.backend.lock.Unlock()
+	return fc.backend.containers[fc.name], nil
+}
+
+func (fc *fakeContainer) CreateIfNotExists(options *storage.CreateContainerOptions) (bool, error) {
+	fc.backend.call()
+	fc.backend.lock.Lock()
+	defer fc.backend.lock.Unlock()
+	if fc.backend.containers[fc.name] {
+		return false, nil
+	}
+	fc.backend.containers[fc.name] = true
+	return true, nil
+}
+
+func (fc *fakeContainer) Metadata() map[string]string {
+	return fc.metadata
+}
+
+func (fc *fakeContainer) GetBlobReference(name string) blobRef {
+	return &fakeBlob{backend: fc.backend, container: fc.name, path: "/" + fc.name + "/" + name, metadata: storage.BlobMetadata{}}
+}
+
+func (fc *fakeContainer) ListBlobs(params storage.ListBlobsParameters) (storage.BlobListResponse, error) {
+	fc.backend.call()
+	return storage.BlobListResponse{}, nil
+}
+
+type fakeBlob struct {
+	backend   *fakeBlobBackend
+	container string
+	path      string
+	props     storage.BlobProperties
+	metadata  storage.BlobMetadata
+}
+
+func (fb *fakeBlob) Properties() *storage.BlobProperties {
+	return &fb.props
+}
+
+func (fb *fakeBlob) Metadata() storage.BlobMetadata {
+	return fb.metadata
+}
+
+// runs f on the stored blob with the backend locked, 404 if there is none
+func (fb *fakeBlob) stored(f func(stored *fakeStoredBlob) error) error {
+	fb.backend.call()
+	fb.backend.lock.Lock()
+	defer fb.backend.lock.Unlock()
+	stored, ok := fb.backend.blobs[fb.path]
+	if !ok {
+		return fakeAzureError(404, "BlobNotFound")
+	}
+	return f(stored)
+}
+
+func (fb *fakeBlob) Exists() (bool, error) {
+	fb.backend.call()
+	fb.backend.lock.Lock()
+	defer fb.backend.lock.Unlock()
+	_, ok := fb.backend.blobs[fb.path]
+	return ok, nil
+}
+
+func (fb *fakeBlob) GetURL() string {
+	return "https://dyskaccount.blob.core.windows.net" + fb.path
+}
+
+func (fb *fakeBlob) GetProperties(options *storage.GetBlobPropertiesOptions) error {
+	return fb.stored(func(stored *fakeStoredBlob) error {
+		fb.props = stored.props
+		fb.metadata = storage.BlobMetadata{}
+		for k, v := range stored.metadata {
+			fb.metadata[k] = v
+		}
+		return nil
+	})
+}
+
+func (fb *fakeBlob) SetProperties(options *storage.SetBlobPropertiesOptions) error {
+	return fb.stored(func(stored *fakeStoredBlob) error {
+		// like the SDK, the length is only sent for page blobs
+		if storage.BlobTypePage != fb.props.BlobType {
+			return nil
+		}
+		stored.props.ContentLength = fb.props.ContentLength
+		return nil
+	})
+}
+
+func (fb *fakeBlob) SetMetadata(options *storage.SetBlobMetadataOptions) error {
+	return fb.stored(func(stored *fakeStoredBlob) error {
+		stored.metadata = storage.BlobMetadata{}
+		for k, v := range fb.metadata {
+			stored.metadata[k] = v
+		}
+		return nil
+	})
+}
+
+func (fb *fakeBlob) GetRange(options *storage.GetBlobRangeOptions) (io.ReadCloser, error) {
+	var data []byte
+	err := fb.stored(func(stored *fakeStoredBlob) error {
+		start, end := options.Range.Start, options.Range.End
+		data = make([]byte, end-start+1)
+		for offset, page := range stored.pages {
+			for i, b := range page {
+				if at := offset + uint64(i); start <= at && end >= at {
+					data[at-start] = b
+				}
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (fb *fakeBlob) PutPageBlob(options *storage.PutBlobOptions) error {
+	fb.backend.call()
+	fb.backend.lock.Lock()
+	defer fb.backend.lock.Unlock()
+	if !fb.backend.containers[fb.container] {
+		return fakeAzureError(404, "ContainerNotFound")
+	}
+	metadata := storage.BlobMetadata{}
+	for k, v := range fb.metadata {
+		metadata[k] = v
+	}
+	fb.backend.blobs[fb.path] = &fakeStoredBlob{
+		props:    storage.BlobProperties{BlobType: storage.BlobTypePage, ContentLength: fb.props.ContentLength},
+		metadata: metadata,
+		pages:    make(map[uint64][]byte),
+	}
+	return nil
+}
+
+func (fb *fakeBlob) WriteRange(blobRange storage.BlobRange, bytes io.Reader, options *storage.PutPageOptions) error {
+	page, err := ioutil.ReadAll(bytes)
+	if nil != err {
+		return err
+	}
+	return fb.stored(func(stored *fakeStoredBlob) error {
+		if 0 < fb.backend.lostWrites {
+			fb.backend.lostWrites--
+			return nil
+		}
+		stored.pages[blobRange.Start] = page
+		return nil
+	})
+}
+
+func (fb *fakeBlob) CreateSnapshot(options *storage.SnapshotOptions) (*time.Time, error) {
+	fb.backend.call()
+	now := time.Now()
+	return &now, nil
+}
+
+func (fb *fakeBlob) Delete(options *storage.DeleteBlobOptions) error {
+	return fb.stored(func(stored *fakeStoredBlob) error {
+		if 0 < len(stored.leaseId) && (nil == options || options.LeaseID != stored.leaseId) {
+			return fakeAzureError(412, "LeaseIdMissing")
+		}
+		delete(fb.backend.blobs, fb.path)
+		return nil
+	})
+}
+
+func (fb *fakeBlob) AcquireLease(leaseTimeInSeconds int, proposedLeaseID string, options *storage.LeaseOptions) (string, error) {
+	var leaseId string
+	err := fb.stored(func(stored *fakeStoredBlob) error {
+		if 0 < len(stored.leaseId) && proposedLeaseID != stored.leaseId {
+			return fakeAzureError(409, "LeaseAlreadyPresent")
+		}
+		if 0 == len(proposedLeaseID) {
+			proposedLeaseID = "fake-lease-" + fb.path
+		}
+		stored.leaseId = proposedLeaseID
+		stored.props.LeaseState = leaseStateLeased
+		leaseId = proposedLeaseID
+		if 0 < fb.backend.lostLeases {
+			fb.backend.lostLeases--
+			return fakeAzureError(500, "InternalError")
+		}
+		return nil
+	})
+	return leaseId, err
+}
+
+func (fb *fakeBlob) RenewLease(currentLeaseID string, options *storage.LeaseOptions) error {
+	return fb.stored(func(stored *fakeStoredBlob) error {
+		if currentLeaseID != stored.leaseId {
+			return fakeAzureError(409, "LeaseIdMismatchWithLeaseOperation")
+		}
+		return nil
+	})
+}
+
+func (fb *fakeBlob) ReleaseLease(currentLeaseID string, options *storage.LeaseOptions) error {
+	return fb.stored(func(stored *fakeStoredBlob) error {
+		if 0 < fb.backend.busyReleases {
+			fb.backend.busyReleases--
+			return fakeAzureError(503, "ServerBusy")
+		}
+		if currentLeaseID != stored.leaseId {
+			return fakeAzureError(409, "LeaseIdMismatchWithLeaseOperation")
+		}
+		stored.leaseId = ""
+		stored.props.LeaseState = "available"
+		return nil
+	})
+}
+
+func (fb *fakeBlob) BreakLeaseWithBreakPeriod(breakPeriodInSeconds int, options *storage.LeaseOptions) (int, error) {
+	err := fb.stored(func(stored *fakeStoredBlob) error {
+		if 0 == len(stored.leaseId) {
+			return fakeAzureError(409, "LeaseNotPresentWithLeaseOperation")
+		}
+		stored.leaseId = ""
+		stored.props.LeaseState = "broken"
+		return nil
+	})
+	return 0, err
+}
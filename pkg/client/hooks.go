@@ -0,0 +1,60 @@
+package client
+
+// MountStage is the point in Mount a MountHooks function is called at
+type MountStage string
+
+const (
+	MountStageValidate MountStage = "validate" // credentials, blob, lease, DNS and module checks
+	MountStageIOCTL    MountStage = "ioctl"    // the mount IOCTL
+	MountStageMounted  MountStage = "mounted"  // the device exists
+)
+
+// MountHooks are called by Mount as it goes, e.g. for audit logs or
+// metrics. Every function is optional. Hooks get a copy of the dysk with
+// AccountKey and SASToken cleared and the lease ids redacted unless
+// WithSecrets is set, changes to it have no effect on the mount
+type MountHooks struct {
+	BeforeValidate func(stage MountStage, d *Dysk)
+	AfterValidate  func(stage MountStage, d *Dysk)
+	BeforeIOCTL    func(stage MountStage, d *Dysk)
+	AfterMount     func(stage MountStage, d *Dysk)
+	// OnError gets the stage that failed
+	OnError     func(stage MountStage, d *Dysk, err error)
+	WithSecrets bool
+}
+
+// WithMountHooks sets hooks called on every Mount
+func WithMountHooks(hooks MountHooks) ClientOption {
+	return func(c *dyskclient) {
+		c.mountHooks = hooks
+	}
+}
+
+// copy of d for hooks
+func (h *MountHooks) dysk(d *Dysk) *Dysk {
+	copied := *d
+	copied.Paths = append([]string(nil), d.Paths...)
+	copied.LeaseIds = append([]string(nil), d.LeaseIds...)
+	copied.segmentSectors = append([]uint64(nil), d.segmentSectors...)
+	if !h.WithSecrets {
+		copied.AccountKey = ""
+		copied.SASToken = ""
+		copied.LeaseId = redact(d.LeaseId)
+		for idx := range copied.LeaseIds {
+			copied.LeaseIds[idx] = redact(copied.LeaseIds[idx])
+		}
+	}
+	return &copied
+}
+
+func (h *MountHooks) fire(hook func(MountStage, *Dysk), stage MountStage, d *Dysk) {
+	if nil != hook {
+		hook(stage, h.dysk(d))
+	}
+}
+
+func (h *MountHooks) fireError(stage MountStage, d *Dysk, err error) {
+	if nil != h.OnError {
+		h.OnError(stage, h.dysk(d), err)
+	}
+}
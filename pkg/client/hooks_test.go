@@ -0,0 +1,31 @@
+package client
+
+import "testing"
+
+func TestMountHooksDysk(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	d.SASToken = "sv=2020-08-04&sig=secret"
+	d.Paths = []string{"/dysks/dysk01", "/dysks/dysk01b"}
+	d.LeaseIds = []string{"lease-dysk01", ""}
+
+	hooks := MountHooks{}
+	copied := hooks.dysk(d)
+	if 0 < len(copied.AccountKey) || 0 < len(copied.SASToken) {
+		t.Fatalf("expected credentials to be cleared got %q %q", copied.AccountKey, copied.SASToken)
+	}
+	if "<redacted>" != copied.LeaseId || "<redacted>" != copied.LeaseIds[0] || "" != copied.LeaseIds[1] {
+		t.Fatalf("expected leases to be redacted got %q %q", copied.LeaseId, copied.LeaseIds)
+	}
+
+	// the hook's copy shares nothing with d
+	copied.Paths[0] = "/changed/by/hook"
+	if "/dysks/dysk01" != d.Paths[0] || "lease-dysk01" != d.LeaseIds[0] || "lease-dysk01" != d.LeaseId {
+		t.Fatalf("hook copy changed the dysk: %q %q %q", d.Paths, d.LeaseIds, d.LeaseId)
+	}
+
+	hooks.WithSecrets = true
+	copied = hooks.dysk(d)
+	if d.AccountKey != copied.AccountKey || d.LeaseId != copied.LeaseId || d.LeaseIds[0] != copied.LeaseIds[0] {
+		t.Fatal("expected secrets with WithSecrets")
+	}
+}
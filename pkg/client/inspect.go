@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/rubiojr/go-vhd/vhd"
+)
+
+// BlobInfo describes a blob as seen by Azure, without mounting it
+type BlobInfo struct {
+	Container     string
+	Name          string
+	BlobType      string
+	ContentLength int64
+	LeaseStatus   string
+	LeaseState    string
+	LeaseDuration string
+	// HasVhdFooter is true if the last 512 bytes of a page blob are a vhd footer
+	HasVhdFooter bool
+}
+
+// InspectBlob reads a blob's type, size, lease and vhd footer using the client's credentials
+func (c *dyskclient) InspectBlob(container string, name string) (_ *BlobInfo, err error) {
+	defer c.observe(OpInspectBlob, time.Now(), &err)
+	ctx := context.Background()
+	blobClient, err := c.ensureBlobService()
+	if nil != err {
+		return nil, err
+	}
+
+	pageBlob, err := c.blobWithProperties(ctx, blobClient, container, name, nil)
+	if nil != err {
+		return nil, err
+	}
+
+	props := pageBlob.Properties()
+	info := newBlobInfo(container, name, props)
+	if storage.BlobTypePage != props.BlobType || vhd.VHD_HEADER_SIZE > props.ContentLength {
+		return info, nil
+	}
+
+	footer, err := c.readVhdFooter(ctx, pageBlob, nil)
+	if nil != err {
+		return nil, err
+	}
+
+	info.HasVhdFooter = isVhdFooter(footer)
+	return info, nil
+}
+
+func newBlobInfo(container string, name string, props *storage.BlobProperties) *BlobInfo {
+	return &BlobInfo{
+		Container:     container,
+		Name:          name,
+		BlobType:      string(props.BlobType),
+		ContentLength: props.ContentLength,
+		LeaseStatus:   props.LeaseStatus,
+		LeaseState:    props.LeaseState,
+		LeaseDuration: props.LeaseDuration,
+	}
+}
+
+// ListPageBlobs lists the page blobs of a container, e.g. to pick one to
+// mount. HasVhdFooter comes from the blob metadata dysk sets at creation,
+// the footer is only read for blobs created by other tools
+func (c *dyskclient) ListPageBlobs(container string) (_ []BlobInfo, err error) {
+	defer c.observe(OpInspectBlob, time.Now(), &err)
+	ctx := context.Background()
+	blobClient, err := c.ensureBlobService()
+	if nil != err {
+		return nil, err
+	}
+	blobContainer := blobClient.GetContainerReference(container)
+
+	var infos []BlobInfo
+	params := storage.ListBlobsParameters{Include: &storage.IncludeBlobDataset{Metadata: true}}
+	for {
+		var res storage.BlobListResponse
+		err := c.doAzure(ctx, func() error {
+			var err error
+			res, err = blobContainer.ListBlobs(params)
+			return err
+		})
+		if isAzureStatus(err, 404) {
+			return nil, fmt.Errorf("Container %s does not exist: %w", container, ErrContainerNotFound)
+		}
+		if nil != err {
+			return nil, err
+		}
+
+		for _, blob := range res.Blobs {
+			if storage.BlobTypePage != blob.Properties.BlobType {
+				continue
+			}
+			info := newBlobInfo(container, blob.Name, &blob.Properties)
+			if info.HasVhdFooter, err = c.listedBlobIsVhd(ctx, blobContainer, blob); nil != err {
+				return nil, err
+			}
+			infos = append(infos, *info)
+		}
+
+		if 0 == len(res.NextMarker) {
+			return infos, nil
+		}
+		params.Marker = res.NextMarker
+	}
+}
+
+// vhd flag of a blob from a listing, by metadata or by its footer
+func (c *dyskclient) listedBlobIsVhd(ctx context.Context, container blobContainer, blob storage.Blob) (bool, error) {
+	if v, ok := blob.Metadata[vhdMetadataKey]; ok {
+		return "1" == v, nil
+	}
+	if vhd.VHD_HEADER_SIZE > blob.Properties.ContentLength {
+		return false, nil
+	}
+
+	pageBlob := container.GetBlobReference(blob.Name)
+	*pageBlob.Properties() = blob.Properties
+	footer, err := c.readVhdFooter(ctx, pageBlob, nil)
+	if nil != err {
+		return false, err
+	}
+	return isVhdFooter(footer), nil
+}
+
+// ProbeContent reads the first sectors of the blob backing d (the first blob
+// of multi blob dysks) with d's lease or snapshot, e.g. to look for a
+// filesystem signature before mounting. Reads at most MAX_PROBE_BYTES and
+// never past the end of the blob. Dynamic vhds are not supported, their
+// first sectors are vhd metadata
+func (c *dyskclient) ProbeContent(d *Dysk, sectors int) (_ []byte, err error) {
+	defer c.observe(OpInspectBlob, time.Now(), &err)
+	probe := *d
+	if isMultiBlob(d) {
+		probe = *segmentDysk(d, 0)
+	}
+	if 0 < len(c.storageAccountName) {
+		probe.AccountName = c.storageAccountName
+	}
+	if 0 == probe.SectorSize {
+		probe.SectorSize = DEFAULT_SECTOR_SIZE
+	}
+	if err := isValidSectorSize(probe.SectorSize); nil != err {
+		return nil, err
+	}
+	if 0 >= sectors || MAX_PROBE_BYTES < uint64(sectors)*uint64(probe.SectorSize) {
+		return nil, fmt.Errorf("Invalid sector count %d. Must be 1 to %d bytes worth of sectors", sectors, MAX_PROBE_BYTES)
+	}
+	if err := isValidBlobPath(probe.Path); nil != err {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	blobClient, err := c.blobServiceForDysk(&probe)
+	if nil != err {
+		return nil, err
+	}
+	getProps, err := blobPropertiesOptions(&probe)
+	if nil != err {
+		return nil, err
+	}
+	containerPath, blobName := blobPathParts(probe.Path)
+	pageBlob, err := c.blobWithProperties(ctx, blobClient, containerPath, blobName, getProps)
+	if nil != err {
+		return nil, err
+	}
+	if storage.BlobTypePage != pageBlob.Properties().BlobType {
+		return nil, fmt.Errorf("Blob at %s: %w", probe.Path, ErrNotPageBlob)
+	}
+	if vhdType, _, err := vhdTypeFromMetadata(pageBlob); nil == err && VhdDynamic == vhdType {
+		return nil, fmt.Errorf("Blob at %s is a dynamic vhd, its content can not be probed", probe.Path)
+	}
+
+	end := uint64(sectors) * uint64(probe.SectorSize)
+	if contentLength := uint64(pageBlob.Properties().ContentLength); contentLength < end {
+		end = contentLength
+	}
+	if 0 == end {
+		return []byte{}, nil
+	}
+
+	getRange := storage.GetBlobRangeOptions{
+		GetBlobOptions: &storage.GetBlobOptions{Snapshot: getProps.Snapshot, LeaseID: getProps.LeaseID},
+		Range:          &storage.BlobRange{Start: 0, End: end - 1},
+	}
+	var content []byte
+	err = c.doAzure(ctx, func() error {
+		r, err := pageBlob.GetRange(&getRange)
+		if nil != err {
+			return err
+		}
+		defer r.Close()
+		content, err = ioutil.ReadAll(r)
+		return err
+	})
+	if nil != err {
+		return nil, err
+	}
+	return content, nil
+}
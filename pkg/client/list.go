@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// DyskInfo is a mounted dysk along with the current properties of its page blob
+// as reported by Azure. Comparing the two detects drift between the kernel and storage
+type DyskInfo struct {
+	*Dysk
+	BlobType      string
+	ContentLength int64
+	LeaseStatus   string
+	LeaseState    string
+	ETag          string
+	LastModified  time.Time
+	// Err is set when the blob properties could not be fetched for this dysk
+	Err error
+}
+
+// MarshalJSON nests the dysk under "Dysk", otherwise the embedded dysk's
+// MarshalJSON would be promoted and drop the blob properties
+func (i DyskInfo) MarshalJSON() ([]byte, error) {
+	errString := ""
+	if nil != i.Err {
+		errString = i.Err.Error()
+	}
+	return json.Marshal(struct {
+		Dysk          *Dysk
+		BlobType      string
+		ContentLength int64
+		LeaseStatus   string
+		LeaseState    string
+		ETag          string
+		LastModified  time.Time
+		Err           string `json:",omitempty"`
+	}{i.Dysk, i.BlobType, i.ContentLength, i.LeaseStatus, i.LeaseState, i.ETag, i.LastModified, errString})
+}
+
+// ListDetailed lists mounted dysks and fetches their page blob properties from Azure.
+// Failing to fetch properties for one dysk is reported on its DyskInfo.Err
+func (c *dyskclient) ListDetailed() ([]*DyskInfo, error) {
+	ctx := context.Background()
+	dysks, err := c.ListContext(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	infos := make([]*DyskInfo, len(dysks))
+	for i, d := range dysks {
+		infos[i] = &DyskInfo{Dysk: d}
+	}
+
+	parallel(len(infos), func(idx int) {
+		infos[idx].Err = c.fetchBlobInfo(ctx, infos[idx])
+	})
+	return infos, nil
+}
+
+func (c *dyskclient) fetchBlobInfo(ctx context.Context, info *DyskInfo) error {
+	d := info.Dysk
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		return err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	blobContainer := blobClient.GetContainerReference(containerPath)
+	pageBlob := blobContainer.GetBlobReference(blobName)
+
+	getProps, err := blobPropertiesOptions(d)
+	if nil != err {
+		return err
+	}
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(getProps)
+	})
+	if nil != err {
+		return err
+	}
+
+	props := pageBlob.Properties()
+	info.BlobType = string(props.BlobType)
+	info.ContentLength = props.ContentLength
+	info.LeaseStatus = props.LeaseStatus
+	info.LeaseState = props.LeaseState
+	info.ETag = props.Etag
+	info.LastModified = time.Time(props.LastModified)
+	return nil
+}
+
+// ListResult is a mounted dysk as read by ListTolerant, either Dysk or Err is set
+type ListResult struct {
+	Name string
+	Dysk *Dysk
+	Err  error
+}
+
+// ListTolerant lists mounted dysks like List but a dysk that can not be read
+// does not fail the others, it gets a result with Err set. The error is only
+// set if the names of mounted dysks could not be listed
+func (c *dyskclient) ListTolerant(ctx context.Context) (_ []ListResult, err error) {
+	defer c.observe(OpList, time.Now(), &err)
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return nil, err
+	}
+	names, err := c.listNames(ctx, f)
+	f.Close()
+	if nil != err {
+		return nil, err
+	}
+
+	results := make([]chan getResult, len(names))
+	for idx := range results {
+		results[idx] = make(chan getResult, 1)
+	}
+
+	parallelWorkers(len(names), func() (func(int), func()) {
+		return c.getWorker(ctx, names, results)
+	})
+
+	listed := make([]ListResult, len(names))
+	for idx, name := range names {
+		res := <-results[idx]
+		listed[idx] = ListResult{Name: name, Dysk: res.d, Err: res.err}
+	}
+	return listed, nil
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Azure round trip the fake blob service takes per call
+const benchmarkAzureLatency = 2 * time.Millisecond
+
+func BenchmarkListDetailed(b *testing.B) {
+	const dyskCount = 64
+
+	backend := newFakeBlobBackend(benchmarkAzureLatency)
+	var dysks []*Dysk
+	for i := 0; i < dyskCount; i++ {
+		d := testDysk(fmt.Sprintf("dysk%02d", i), i)
+		backend.addPageBlob(d.Path, int64(d.sectorCount)*DEFAULT_SECTOR_SIZE, d.LeaseId)
+		dysks = append(dysks, d)
+	}
+	c := withFakeModule(b, newFakeModule(dysks...), withBlobBackend(backend))
+
+	// one dysk after the other, what ListDetailed did before fanning out
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			listed, err := c.List()
+			if nil != err {
+				b.Fatal(err)
+			}
+			for _, d := range listed {
+				if err := c.fetchBlobInfo(context.Background(), &DyskInfo{Dysk: d}); nil != err {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			infos, err := c.ListDetailed()
+			if nil != err {
+				b.Fatal(err)
+			}
+			for _, info := range infos {
+				if nil != info.Err {
+					b.Fatal(info.Err)
+				}
+			}
+		}
+	})
+}
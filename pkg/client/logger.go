@@ -0,0 +1,32 @@
+package client
+
+import (
+	"log"
+	"os"
+)
+
+// Logger receives the client's informational messages. *log.Logger
+// satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// NopLogger discards all messages
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+// default, same output the client always had
+var stderrLogger Logger = log.New(os.Stderr, "", 0)
+
+// WithLogger routes the client's informational messages to l instead of
+// stderr. Use NopLogger to silence them
+func WithLogger(l Logger) ClientOption {
+	return func(c *dyskclient) {
+		if nil != l {
+			c.logger = l
+		}
+	}
+}
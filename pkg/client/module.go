@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ModuleCapability is a bit in the capability bitmap reported by the kernel module
+type ModuleCapability uint64
+
+const (
+	CapabilityResize      ModuleCapability = 1 << 0  // online resize IOCTL
+	CapabilitySAS         ModuleCapability = 1 << 1  // auth with SAS tokens
+	CapabilitySectorSize  ModuleCapability = 1 << 2  // sector sizes other than 512
+	CapabilityIPv6        ModuleCapability = 1 << 3  // storage hosts over IPv6
+	CapabilityPing        ModuleCapability = 1 << 4  // ping IOCTL
+	CapabilityStats       ModuleCapability = 1 << 5  // error counters IOCTL
+	CapabilityQueueTuning ModuleCapability = 1 << 6  // read ahead and queue depth on mount
+	CapabilityCacheMode   ModuleCapability = 1 << 7  // cache modes other than none
+	CapabilityDynamicVhd  ModuleCapability = 1 << 8  // dynamic (sparse) vhd dysks
+	CapabilityRemount     ModuleCapability = 1 << 9  // remount IOCTL
+	CapabilityAuthUpdate  ModuleCapability = 1 << 10 // SAS token update IOCTL
+	CapabilityMultiBlob   ModuleCapability = 1 << 11 // dysks backed by several page blobs
+	CapabilityKeyUpdate   ModuleCapability = 1 << 12 // account key in the auth update IOCTL
+	CapabilityUnleased    ModuleCapability = 1 << 13 // unleased R (and snapshot) mounts
+)
+
+// ModuleInfo describes the loaded kernel module. Modules that predate the
+// module info IOCTL are reported with an empty Version and no capabilities
+type ModuleInfo struct {
+	Version      string
+	Capabilities ModuleCapability
+	BufferSize   int // IOCTL buffer size the module reads and writes
+}
+
+// Has is true if the module supports all of caps
+func (mi *ModuleInfo) Has(caps ModuleCapability) bool {
+	return caps == mi.Capabilities&caps
+}
+
+// ModuleInfo queries the loaded kernel module for its version and capabilities
+func (c *dyskclient) ModuleInfo() (_ *ModuleInfo, err error) {
+	defer c.observe(OpModuleInfo, time.Now(), &err)
+	// reports the module's buffer size even when the client's does not match
+	f, err := c.openDeviceHandle()
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := c.queryModuleInfo(context.Background(), f)
+	if nil != err {
+		return nil, err
+	}
+
+	c.moduleLock.Lock()
+	c.moduleInfo = info
+	c.moduleLock.Unlock()
+	return info, nil
+}
+
+// module info, queried once per client
+func (c *dyskclient) cachedModuleInfo(ctx context.Context, f *deviceHandle) (*ModuleInfo, error) {
+	c.moduleLock.Lock()
+	defer c.moduleLock.Unlock()
+
+	if nil != c.moduleInfo {
+		return c.moduleInfo, nil
+	}
+
+	info, err := c.queryModuleInfo(ctx, f)
+	if nil != err {
+		return nil, err
+	}
+	c.moduleInfo = info
+	return info, nil
+}
+
+func (c *dyskclient) queryModuleInfo(ctx context.Context, f *deviceHandle) (*ModuleInfo, error) {
+	buffer, err := bufferize("-", c.ioctlBufferSize)
+	if nil != err {
+		return nil, err
+	}
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	n, e := ioctl(f.Fd(), IOCTLMODULEINFO, buffer)
+	if syscall.ENOTTY == e {
+		// legacy module
+		return &ModuleInfo{BufferSize: IOCTL_IN_OUT_MAX}, nil
+	}
+	if e != 0 {
+		return nil, &IOCTLError{Cmd: IOCTLMODULEINFO, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return nil, err
+	}
+	if res.is_error {
+		return nil, &ModuleResponseError{Response: res.response}
+	}
+
+	// version-capabilities-buffersize
+	split := strings.Split(res.response, "\n")
+	if 3 > len(split) {
+		return nil, fmt.Errorf("Invalid module info response:%q", res.response)
+	}
+
+	caps, err := strconv.ParseUint(split[1], 10, 64)
+	if nil != err {
+		return nil, fmt.Errorf("Invalid module capabilities:%s", split[1])
+	}
+	bufferSize, err := strconv.Atoi(split[2])
+	if nil != err {
+		return nil, fmt.Errorf("Invalid module buffer size:%s", split[2])
+	}
+
+	return &ModuleInfo{
+		Version:      split[0],
+		Capabilities: ModuleCapability(caps),
+		BufferSize:   bufferSize,
+	}, nil
+}
+
+// The module copies its own buffer size from and to the client's buffer
+// whatever the client's size is, fails with ErrBufferSizeMismatch unless
+// both agree. Legacy modules use IOCTL_IN_OUT_MAX
+func (c *dyskclient) negotiateBufferSize(f *deviceHandle) error {
+	info, err := c.cachedModuleInfo(context.Background(), f)
+	if nil != err {
+		return err
+	}
+	if 0 < info.BufferSize && c.ioctlBufferSize != info.BufferSize {
+		return fmt.Errorf("IOCTL buffer size is %d bytes, the module's is %d (see WithIOCTLBufferSize): %w", c.ioctlBufferSize, info.BufferSize, ErrBufferSizeMismatch)
+	}
+	return nil
+}
+
+// fails with ErrUnsupportedByModule if the loaded module lacks any of caps
+func (c *dyskclient) requireCapabilities(ctx context.Context, f *deviceHandle, caps ModuleCapability, feature string) error {
+	info, err := c.cachedModuleInfo(ctx, f)
+	if nil != err {
+		return err
+	}
+	if !info.Has(caps) {
+		return fmt.Errorf("%s (module version:%q): %w", feature, info.Version, ErrUnsupportedByModule)
+	}
+	return nil
+}
+
+// capabilities the module needs to mount d as requested
+func (c *dyskclient) checkMountCapabilities(ctx context.Context, f *deviceHandle, d *Dysk) error {
+	if 0 < len(d.SASToken) {
+		if err := c.requireCapabilities(ctx, f, CapabilitySAS, "SAS token auth"); nil != err {
+			return err
+		}
+	}
+	if DEFAULT_SECTOR_SIZE != d.SectorSize {
+		if err := c.requireCapabilities(ctx, f, CapabilitySectorSize, fmt.Sprintf("Sector size %d", d.SectorSize)); nil != err {
+			return err
+		}
+	}
+	if 0 < len(d.CacheMode) && CacheModeNone != d.CacheMode {
+		if err := c.requireCapabilities(ctx, f, CapabilityCacheMode, fmt.Sprintf("Cache mode %s", d.CacheMode)); nil != err {
+			return err
+		}
+	}
+	if 0 == len(d.LeaseId) {
+		if err := c.requireCapabilities(ctx, f, CapabilityUnleased, "Unleased mount"); nil != err {
+			return err
+		}
+	}
+	if isMultiBlob(d) {
+		if err := c.requireCapabilities(ctx, f, CapabilityMultiBlob, "Multi blob dysk"); nil != err {
+			return err
+		}
+	}
+	if VhdDynamic == d.VhdType {
+		if err := c.requireCapabilities(ctx, f, CapabilityDynamicVhd, "Dynamic vhd"); nil != err {
+			return err
+		}
+	}
+	if ipFamily6 == ipFamily(d.ip) {
+		if err := c.requireCapabilities(ctx, f, CapabilityIPv6, "IPv6 storage host"); nil != err {
+			return err
+		}
+	}
+	return nil
+}
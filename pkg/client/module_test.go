@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNegotiateBufferSize(t *testing.T) {
+	cases := []struct {
+		name       string
+		info       *ModuleInfo
+		bufferSize int
+		err        error
+	}{
+		{"legacy module", nil, 0, nil},
+		{"legacy module larger client buffer", nil, 2 * IOCTL_IN_OUT_MAX, ErrBufferSizeMismatch},
+		{"default buffer", &ModuleInfo{Version: "0.2.0", BufferSize: IOCTL_IN_OUT_MAX}, 0, nil},
+		{"larger module buffer", &ModuleInfo{Version: "0.2.0", BufferSize: 2 * IOCTL_IN_OUT_MAX}, 0, ErrBufferSizeMismatch},
+		{"larger buffer on both sides", &ModuleInfo{Version: "0.2.0", BufferSize: 2 * IOCTL_IN_OUT_MAX}, 2 * IOCTL_IN_OUT_MAX, nil},
+		{"client buffer above the module's", &ModuleInfo{Version: "0.2.0", BufferSize: IOCTL_IN_OUT_MAX}, 2 * IOCTL_IN_OUT_MAX, ErrBufferSizeMismatch},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newFakeModule(testDysk("dysk01", 1))
+			m.info = tc.info
+			c := withFakeModule(t, m, WithIOCTLBufferSize(tc.bufferSize))
+
+			_, err := c.List()
+			if nil == tc.err && nil != err {
+				t.Fatal(err)
+			}
+			if nil != tc.err && !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v got %v", tc.err, err)
+			}
+
+			// the module's buffer size is reported either way
+			info, err := c.ModuleInfo()
+			if nil != err {
+				t.Fatal(err)
+			}
+			if nil != tc.info && tc.info.BufferSize != info.BufferSize {
+				t.Fatalf("expected buffer size %d got %d", tc.info.BufferSize, info.BufferSize)
+			}
+		})
+	}
+}
+
+func TestCheckMountCapabilitiesUnleased(t *testing.T) {
+	leased := testDysk("dysk01", 1)
+	leased.Type = ReadOnly
+	unleased := testDysk("dysk02", 2)
+	unleased.Type = ReadOnly
+	unleased.LeaseId = ""
+
+	cases := []struct {
+		name string
+		info *ModuleInfo
+		d    *Dysk
+		err  error
+	}{
+		{"leased on legacy module", nil, leased, nil},
+		{"unleased on legacy module", nil, unleased, ErrUnsupportedByModule},
+		{"unleased without capability", &ModuleInfo{BufferSize: IOCTL_IN_OUT_MAX, Capabilities: CapabilityResize}, unleased, ErrUnsupportedByModule},
+		{"unleased with capability", &ModuleInfo{BufferSize: IOCTL_IN_OUT_MAX, Capabilities: CapabilityUnleased}, unleased, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newFakeModule()
+			m.info = tc.info
+			c := withFakeModule(t, m)
+
+			f, err := c.openDeviceFile()
+			if nil != err {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			err = c.checkMountCapabilities(context.Background(), f, tc.d)
+			if nil == tc.err && nil != err {
+				t.Fatal(err)
+			}
+			if nil != tc.err && !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v got %v", tc.err, err)
+			}
+		})
+	}
+}
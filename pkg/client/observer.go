@@ -0,0 +1,52 @@
+package client
+
+import "time"
+
+// Operations reported to an Observer
+const (
+	OpMount          = "mount"
+	OpUnmount        = "unmount" // also UnmountAndReleaseLease, ForceUnmount and each dysk of UnmountAll
+	OpGet            = "get"     // Get and GetContext
+	OpList           = "list"    // also ListTolerant
+	OpResize         = "resize"
+	OpRemount        = "remount"
+	OpSnapshot       = "snapshot"
+	OpPing           = "ping"
+	OpStats          = "stats"      // Stats and ListStats
+	OpUpdateAuth     = "updateauth" // RotateKey and RefreshCredentials
+	OpModuleInfo     = "moduleinfo"
+	OpCreatePageBlob = "createpageblob" // also each blob of CreatePageBlobs
+	OpDeletePageBlob = "deletepageblob"
+	OpInspectBlob    = "inspectblob" // InspectBlob, ListPageBlobs and ProbeContent
+	OpRenewLease     = "renewlease"  // each renewal of StartLeaseRenewal
+	OpVerifySize     = "verifysize"
+)
+
+// Observer is told about every operation of the client that talks to the
+// kernel module or Azure, one of the Op constants, e.g. to export latency
+// and error metrics. Operations built on others report those instead
+// (ListDetailed lists then reads blob properties, DeletePageBlob lists
+// mounted dysks first). ObserveOp is called on the caller's goroutine, or
+// the renewal goroutine for OpRenewLease, and must be safe for concurrent
+// use
+type Observer interface {
+	ObserveOp(op string, dur time.Duration, err error)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveOp(op string, dur time.Duration, err error) {}
+
+// WithObserver reports the client's operations to o
+func WithObserver(o Observer) ClientOption {
+	return func(c *dyskclient) {
+		if nil != o {
+			c.observer = o
+		}
+	}
+}
+
+// meant to be deferred with the start time and the operation's named error
+func (c *dyskclient) observe(op string, start time.Time, err *error) {
+	c.observer.ObserveOp(op, time.Since(start), *err)
+}
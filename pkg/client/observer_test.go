@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	lock sync.Mutex
+	ops  []string
+}
+
+func (o *recordingObserver) ObserveOp(op string, dur time.Duration, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.ops = append(o.ops, op)
+}
+
+func TestObserverReportsOps(t *testing.T) {
+	cases := []struct {
+		op   string
+		call func(c *dyskclient)
+	}{
+		{OpList, func(c *dyskclient) { c.ListTolerant(context.Background()) }},
+		{OpPing, func(c *dyskclient) { c.Ping("dysk01") }},
+		{OpStats, func(c *dyskclient) { c.Stats("dysk01") }},
+		{OpRemount, func(c *dyskclient) { c.Remount("dysk01", ReadOnly) }},
+		{OpUpdateAuth, func(c *dyskclient) { c.RotateKey("dysk01", "bmV3a2V5") }},
+		{OpModuleInfo, func(c *dyskclient) { c.ModuleInfo() }},
+		{OpUnmount, func(c *dyskclient) { c.ForceUnmount("dysk01") }},
+		{OpSnapshot, func(c *dyskclient) { c.Snapshot("dysk01") }},
+		{OpVerifySize, func(c *dyskclient) { c.VerifySize("dysk01") }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.op, func(t *testing.T) {
+			o := &recordingObserver{}
+			c := withFakeModule(t, newFakeModule(testDysk("dysk01", 1)), WithObserver(o), withBlobBackend(newFakeBlobBackend(0)))
+			tc.call(c)
+
+			o.lock.Lock()
+			defer o.lock.Unlock()
+			for _, op := range o.ops {
+				if tc.op == op {
+					return
+				}
+			}
+			t.Fatalf("expected %s to be observed got %v", tc.op, o.ops)
+		})
+	}
+}
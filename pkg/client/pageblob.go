@@ -0,0 +1,543 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/rubiojr/go-vhd/vhd"
+)
+
+// Stages reported to PageBlobSpec.Progress
+const (
+	PageBlobStageCreate    = "create"
+	PageBlobStageVhdFooter = "vhd-footer"
+	PageBlobStageVhdHeader = "vhd-header" // dynamic vhd header and BAT
+	PageBlobStageLease     = "lease"
+)
+
+// ContainerAccess is the public access level of a container created by CreatePageBlobWithSpec
+type ContainerAccess string
+
+const (
+	ContainerAccessPrivate   ContainerAccess = ""          // no anonymous access, the default
+	ContainerAccessBlob      ContainerAccess = "blob"      // anonymous reads of blobs
+	ContainerAccessContainer ContainerAccess = "container" // anonymous reads and listing
+)
+
+// PageBlobSpec describes a page blob to create
+type PageBlobSpec struct {
+	Container string
+	Name      string
+	SizeBytes uint64 // total blob size, including the vhd footer if any. Virtual disk size for dynamic vhds
+	Vhd       bool
+	// VhdType defaults to fixed. Dynamic vhds need a module with
+	// CapabilityDynamicVhd to mount
+	VhdType VhdType
+	// Access level and metadata of the container if it has to be created.
+	// Existing containers are left as they are
+	ContainerAccess   ContainerAccess
+	ContainerMetadata map[string]string
+	// RequireContainer fails with ErrContainerNotFound instead of creating a
+	// missing container, where containers are provisioned separately
+	RequireContainer bool
+	// IfNotExists reuses an existing page blob of the same size instead of
+	// failing. It is leased again with LeaseId, pass the current lease id if the
+	// blob is already leased
+	IfNotExists bool
+	// LeaseId is the proposed lease id, Azure generates one if empty
+	LeaseId string
+	// LeaseDuration in seconds, 15 to 60 or INFINITE_LEASE. 0 is infinite
+	LeaseDuration int
+	// KeepOnFailure keeps a newly created blob when writing the vhd or
+	// leasing it fails, by default it is deleted
+	KeepOnFailure bool
+	// Progress, if set, is called at the start and end of each stage. done and
+	// total are bytes for create and vhd-footer, 0 or 1 for lease
+	Progress func(stage string, done int64, total int64)
+}
+
+func (spec *PageBlobSpec) progress(stage string, done int64, total int64) {
+	if nil != spec.Progress {
+		spec.Progress(stage, done, total)
+	}
+}
+
+// PageBlobResult is the outcome of CreatePageBlobWithSpec
+type PageBlobResult struct {
+	LeaseId string
+	Path    string // /container/blob, as used by Dysk.Path
+	URL     string
+	Created bool // false if an existing blob was reused
+	// ContainerCreated is true if the container did not exist
+	ContainerCreated bool
+	// Err is set by CreatePageBlobs when creating this blob failed
+	Err error
+}
+
+// CreatePageBlobWithSpec creates (or with IfNotExists, reuses) a page blob and leases it
+func (c *dyskclient) CreatePageBlobWithSpec(ctx context.Context, spec *PageBlobSpec) (_ *PageBlobResult, err error) {
+	defer c.observe(OpCreatePageBlob, time.Now(), &err)
+	if _, _, err := pageBlobLayout(spec); nil != err {
+		return nil, err
+	}
+
+	blobClient, err := c.ensureBlobService()
+	if nil != err {
+		return nil, err
+	}
+
+	blobContainer, containerCreated, err := c.ensureContainer(ctx, blobClient, spec)
+	if nil != err {
+		return nil, err
+	}
+	return c.createPageBlob(ctx, blobContainer, spec, containerCreated)
+}
+
+// CreatePageBlobs creates (or reuses, see PageBlobSpec.IfNotExists) many page
+// blobs at once. Each container is created once, with the access level,
+// metadata and RequireContainer of the first spec naming it, then blobs are created by
+// PARALLEL_WORKERS workers. Results are in the order of specs, a spec
+// that failed has its Err set. The error is only set if nothing could be tried
+func (c *dyskclient) CreatePageBlobs(ctx context.Context, specs []PageBlobSpec) ([]PageBlobResult, error) {
+	blobClient, err := c.ensureBlobService()
+	if nil != err {
+		return nil, err
+	}
+
+	results := make([]PageBlobResult, len(specs))
+	for idx := range specs {
+		results[idx].Path = blobPath(&specs[idx])
+	}
+
+	type containerState struct {
+		blobContainer blobContainer
+		created       bool
+		err           error
+	}
+	containers := make(map[string]*containerState)
+	for idx := range specs {
+		spec := &specs[idx]
+		if _, ok := containers[spec.Container]; ok {
+			continue
+		}
+		state := &containerState{}
+		state.blobContainer, state.created, state.err = c.ensureContainer(ctx, blobClient, spec)
+		containers[spec.Container] = state
+	}
+
+	parallel(len(specs), func(idx int) {
+		spec := &specs[idx]
+		state := containers[spec.Container]
+		if nil != state.err {
+			results[idx].Err = state.err
+			return
+		}
+		start := time.Now()
+		result, err := c.createPageBlob(ctx, state.blobContainer, spec, state.created)
+		c.observe(OpCreatePageBlob, start, &err)
+		if nil != err {
+			results[idx].Err = err
+			return
+		}
+		results[idx] = *result
+	})
+	return results, nil
+}
+
+// creates spec's container if needed, with its access level and metadata
+func (c *dyskclient) ensureContainer(ctx context.Context, blobClient blobBackend, spec *PageBlobSpec) (blobContainer, bool, error) {
+	if err := isValidContainerAccess(spec.ContainerAccess); nil != err {
+		return nil, false, err
+	}
+
+	blobContainer := blobClient.GetContainerReference(spec.Container)
+	if spec.RequireContainer {
+		var exists bool
+		err := c.doAzure(ctx, func() error {
+			var err error
+			exists, err = blobContainer.Exists()
+			return err
+		})
+		if nil != err {
+			return nil, false, err
+		}
+		if !exists {
+			return nil, false, fmt.Errorf("Container %s does not exist and RequireContainer is set: %w", spec.Container, ErrContainerNotFound)
+		}
+		return blobContainer, false, nil
+	}
+
+	for k, v := range spec.ContainerMetadata {
+		blobContainer.Metadata()[k] = v
+	}
+	createOptions := storage.CreateContainerOptions{
+		Access: storage.ContainerAccessType(spec.ContainerAccess),
+	}
+
+	var containerCreated bool
+	err := c.doAzure(ctx, func() error {
+		var err error
+		containerCreated, err = blobContainer.CreateIfNotExists(&createOptions)
+		return err
+	})
+	if nil != err {
+		return nil, false, err
+	}
+	if containerCreated {
+		c.logger.Printf("Created container in account:%s %s(access:%q)\n", c.storageAccountName, spec.Container, spec.ContainerAccess)
+	}
+	return blobContainer, containerCreated, nil
+}
+
+// creates the page blob of spec in blobContainer, which must exist
+func (c *dyskclient) createPageBlob(ctx context.Context, blobContainer blobContainer, spec *PageBlobSpec, containerCreated bool) (*PageBlobResult, error) {
+	blobSize, dynamic, err := pageBlobLayout(spec)
+	if nil != err {
+		return nil, err
+	}
+
+	pageBlob := blobContainer.GetBlobReference(spec.Name)
+
+	if spec.IfNotExists {
+		var exists bool
+		err = c.doAzure(ctx, func() error {
+			var err error
+			exists, err = pageBlob.Exists()
+			return err
+		})
+		if nil != err {
+			return nil, err
+		}
+		if exists {
+			result, err := c.reusePageBlob(ctx, pageBlob, spec)
+			if nil != err {
+				return nil, err
+			}
+			result.ContainerCreated = containerCreated
+			return result, nil
+		}
+	}
+
+	spec.progress(PageBlobStageCreate, 0, int64(blobSize))
+	pageBlob.Properties().ContentLength = int64(blobSize)
+	pageBlob.Metadata()[vhdMetadataKey] = vhdMetadataValue(spec.Vhd)
+	if spec.Vhd {
+		pageBlob.Metadata()[vhdTypeMetadataKey] = string(specVhdType(spec))
+	}
+	if nil != dynamic {
+		pageBlob.Metadata()[vhdSizeMetadataKey] = strconv.FormatUint(spec.SizeBytes, 10)
+	}
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.PutPageBlob(nil)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	spec.progress(PageBlobStageCreate, int64(blobSize), int64(blobSize))
+	c.logger.Printf("Created PageBlob in account:%s %s/%s(%d bytes)\n", c.storageAccountName, spec.Container, spec.Name, blobSize)
+
+	// is it vhd?
+	if nil != dynamic {
+		if err = c.writeDynamicVhd(ctx, pageBlob, dynamic, spec); nil != err {
+			c.cleanupPageBlob(pageBlob, spec, "")
+			return nil, err
+		}
+
+		c.logger.Printf("Wrote dynamic VHD header for PageBlob in account:%s %s/%s\n", c.storageAccountName, spec.Container, spec.Name)
+	} else if spec.Vhd {
+		spec.progress(PageBlobStageVhdFooter, 0, vhd.VHD_HEADER_SIZE)
+		if err = c.writeVhdFooter(ctx, pageBlob, spec.SizeBytes, ""); nil != err {
+			c.cleanupPageBlob(pageBlob, spec, "")
+			return nil, err
+		}
+		spec.progress(PageBlobStageVhdFooter, vhd.VHD_HEADER_SIZE, vhd.VHD_HEADER_SIZE)
+
+		c.logger.Printf("Wrote VHD header for PageBlob in account:%s %s/%s\n", c.storageAccountName, spec.Container, spec.Name)
+	}
+
+	// lease it, always under a known id so retries and the cleanup can use it
+	spec.progress(PageBlobStageLease, 0, 1)
+	proposedLeaseId, err := proposeLeaseId(spec.LeaseId)
+	if nil != err {
+		c.cleanupPageBlob(pageBlob, spec, "")
+		return nil, err
+	}
+	leaseId, err := c.acquireLease(ctx, pageBlob, spec.leaseDuration(), proposedLeaseId)
+	if nil != err {
+		// the lease may have been taken even though the call failed, a
+		// proposed id is enough to release it
+		c.cleanupPageBlob(pageBlob, spec, proposedLeaseId)
+		return nil, err
+	}
+	spec.progress(PageBlobStageLease, 1, 1)
+
+	return &PageBlobResult{LeaseId: leaseId, Path: blobPath(spec), URL: pageBlob.GetURL(), Created: true, ContainerCreated: containerCreated}, nil
+}
+
+// Best effort undo of a page blob creation that failed half way: releases
+// leaseId (if any) and, unless spec.KeepOnFailure, deletes the blob. Runs
+// even if the creation's ctx is done, failures are only logged. True if the
+// blob was deleted
+func (c *dyskclient) cleanupPageBlob(pageBlob blobRef, spec *PageBlobSpec, leaseId string) bool {
+	ctx := context.Background()
+	if 0 < len(leaseId) {
+		err := c.doAzure(ctx, func() error {
+			return pageBlob.ReleaseLease(leaseId, nil)
+		})
+		if nil != err && !isAzureStatus(err, 404, 409) {
+			c.logger.Printf("Failed to release lease of PageBlob %s/%s after failed creation:%s\n", spec.Container, spec.Name, err.Error())
+		}
+	}
+
+	if spec.KeepOnFailure {
+		c.logger.Printf("Kept PageBlob %s/%s after failed creation\n", spec.Container, spec.Name)
+		return false
+	}
+
+	err := c.doAzure(ctx, func() error {
+		return pageBlob.Delete(nil)
+	})
+	if nil != err {
+		c.logger.Printf("Failed to delete PageBlob %s/%s after failed creation:%s\n", spec.Container, spec.Name, err.Error())
+		return false
+	}
+	c.logger.Printf("Deleted PageBlob %s/%s after failed creation\n", spec.Container, spec.Name)
+	return true
+}
+
+func isValidContainerAccess(access ContainerAccess) error {
+	switch access {
+	case ContainerAccessPrivate, ContainerAccessBlob, ContainerAccessContainer:
+		return nil
+	}
+	return fmt.Errorf("Invalid container access %q, must be empty (private), %s or %s", access, ContainerAccessBlob, ContainerAccessContainer)
+}
+
+// validates spec, returns the blob size and, for dynamic vhds, their layout
+func pageBlobLayout(spec *PageBlobSpec) (uint64, *dynamicVhd, error) {
+	if err := isValidLeaseDuration(spec.leaseDuration()); nil != err {
+		return 0, nil, err
+	}
+	if LEASE_ID_LEN < len(spec.LeaseId) {
+		return 0, nil, fmt.Errorf("Invalid lease id. Must be <= %d", LEASE_ID_LEN)
+	}
+
+	if 0 < len(spec.VhdType) {
+		if !spec.Vhd {
+			return 0, nil, fmt.Errorf("Invalid vhd type %s for a page blob that is not vhd", spec.VhdType)
+		}
+		if err := isValidVhdType(spec.VhdType); nil != err {
+			return 0, nil, err
+		}
+	}
+
+	if VhdDynamic != spec.VhdType {
+		return spec.SizeBytes, nil, isValidPageBlobSize(spec.SizeBytes, spec.Vhd)
+	}
+
+	if err := isValidPageBlobSize(spec.SizeBytes, false); nil != err {
+		return 0, nil, err
+	}
+	dynamic := newDynamicVhd(spec.SizeBytes)
+	if err := isValidPageBlobSize(dynamic.blobSize(), false); nil != err {
+		return 0, nil, fmt.Errorf("Dynamic vhd of %d bytes does not fit in a page blob. Error:%s", spec.SizeBytes, err.Error())
+	}
+	return dynamic.blobSize(), dynamic, nil
+}
+
+func specVhdType(spec *PageBlobSpec) VhdType {
+	if 0 == len(spec.VhdType) {
+		return VhdFixed
+	}
+	return spec.VhdType
+}
+
+// Writes the footer copy, dynamic header and BAT at the start of the blob
+// and the footer in its last sector, then reads the footers and the dynamic
+// header back. A write that does not verify is retried once
+func (c *dyskclient) writeDynamicVhd(ctx context.Context, pageBlob blobRef, dynamic *dynamicVhd, spec *PageBlobSpec) error {
+	footer, err := dynamic.footer()
+	if nil != err {
+		return err
+	}
+	head := dynamic.head(footer)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if err = c.putDynamicVhd(ctx, pageBlob, dynamic, head, footer, spec); nil != err {
+			return err
+		}
+		if err = c.verifyDynamicVhd(ctx, pageBlob, dynamic, head, footer); nil == err {
+			c.logger.Printf("Verified dynamic VHD of PageBlob %s (attempt %d)\n", pageBlob.GetURL(), attempt)
+			return nil
+		}
+		c.logger.Printf("Dynamic VHD of PageBlob %s failed verification (attempt %d). Error:%s\n", pageBlob.GetURL(), attempt, err.Error())
+	}
+	return err
+}
+
+func (c *dyskclient) putDynamicVhd(ctx context.Context, pageBlob blobRef, dynamic *dynamicVhd, head []byte, footer []byte, spec *PageBlobSpec) error {
+	total := int64(len(head) + len(footer))
+	spec.progress(PageBlobStageVhdHeader, 0, total)
+
+	putPageOptions := storage.PutPageOptions{}
+	for start := 0; start < len(head); start += MAX_PUT_PAGE_BYTES {
+		end := start + MAX_PUT_PAGE_BYTES
+		if end > len(head) {
+			end = len(head)
+		}
+		blobRange := storage.BlobRange{
+			Start: uint64(start),
+			End:   uint64(end - 1),
+		}
+		err := c.doAzure(ctx, func() error {
+			return pageBlob.WriteRange(blobRange, bytes.NewBuffer(head[start:end]), &putPageOptions)
+		})
+		if nil != err {
+			return err
+		}
+		spec.progress(PageBlobStageVhdHeader, int64(end), total)
+	}
+
+	blobSize := dynamic.blobSize()
+	blobRange := storage.BlobRange{
+		Start: blobSize - uint64(len(footer)),
+		End:   blobSize - 1,
+	}
+	err := c.doAzure(ctx, func() error {
+		return pageBlob.WriteRange(blobRange, bytes.NewBuffer(footer), &putPageOptions)
+	})
+	if nil != err {
+		return err
+	}
+	spec.progress(PageBlobStageVhdHeader, total, total)
+	return nil
+}
+
+// the footer copy and dynamic header at the start of the blob and the footer
+// in its last sector must read back as written
+func (c *dyskclient) verifyDynamicVhd(ctx context.Context, pageBlob blobRef, dynamic *dynamicVhd, head []byte, footer []byte) error {
+	written := head[:vhd.VHD_HEADER_SIZE+vhdDynamicHeaderSize]
+	read, err := c.readPageRange(ctx, pageBlob, 0, uint64(len(written)), nil)
+	if nil != err {
+		return err
+	}
+	if !bytes.Equal(written, read) {
+		return fmt.Errorf("Footer copy and dynamic header do not read back as written: %w", ErrInvalidVhd)
+	}
+
+	read, err = c.readPageRange(ctx, pageBlob, dynamic.blobSize()-uint64(len(footer)), uint64(len(footer)), nil)
+	if nil != err {
+		return err
+	}
+	if err = isValidVhdFooter(read); nil != err {
+		return err
+	}
+	if !bytes.Equal(footer, read) {
+		return fmt.Errorf("Footer does not match its copy at the start of the blob: %w", ErrInvalidVhd)
+	}
+	return nil
+}
+
+func blobPath(spec *PageBlobSpec) string {
+	return "/" + spec.Container + "/" + spec.Name
+}
+
+func vhdMetadataValue(is_vhd bool) string {
+	if is_vhd {
+		return "1"
+	}
+	return "0"
+}
+
+// checks an existing blob matches spec and leases it
+func (c *dyskclient) reusePageBlob(ctx context.Context, pageBlob blobRef, spec *PageBlobSpec) (*PageBlobResult, error) {
+	err := c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(nil)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	if storage.BlobTypePage != pageBlob.Properties().BlobType {
+		return nil, fmt.Errorf("Blob at /%s/%s: %w", spec.Container, spec.Name, ErrNotPageBlob)
+	}
+	blobSize, _, err := pageBlobLayout(spec)
+	if nil != err {
+		return nil, err
+	}
+	if int64(blobSize) != pageBlob.Properties().ContentLength {
+		return nil, fmt.Errorf("Page blob /%s/%s exists with size %d bytes, wanted %d", spec.Container, spec.Name, pageBlob.Properties().ContentLength, blobSize)
+	}
+	if is_vhd, ok := vhdFromMetadata(pageBlob); ok && is_vhd != spec.Vhd {
+		return nil, fmt.Errorf("Page blob /%s/%s exists with vhd:%t, wanted vhd:%t", spec.Container, spec.Name, is_vhd, spec.Vhd)
+	}
+	if spec.Vhd {
+		vhdType, _, err := vhdTypeFromMetadata(pageBlob)
+		if nil != err {
+			return nil, fmt.Errorf("Page blob /%s/%s: %s", spec.Container, spec.Name, err.Error())
+		}
+		if vhdType != specVhdType(spec) {
+			return nil, fmt.Errorf("Page blob /%s/%s exists with vhd type %s, wanted %s", spec.Container, spec.Name, vhdType, specVhdType(spec))
+		}
+	}
+
+	spec.progress(PageBlobStageLease, 0, 1)
+	leaseId, err := c.acquireLease(ctx, pageBlob, spec.leaseDuration(), spec.LeaseId)
+	if nil != err {
+		// leased under a different id
+		if isAzureStatus(err, 409) {
+			return nil, fmt.Errorf("Page blob /%s/%s is leased with a different lease id: %w", spec.Container, spec.Name, err)
+		}
+		return nil, err
+	}
+
+	spec.progress(PageBlobStageLease, 1, 1)
+
+	c.logger.Printf("Reusing PageBlob in account:%s %s/%s(%d bytes)\n", c.storageAccountName, spec.Container, spec.Name, spec.SizeBytes)
+	return &PageBlobResult{LeaseId: leaseId, Path: blobPath(spec), URL: pageBlob.GetURL(), Created: false}, nil
+}
+
+func (spec *PageBlobSpec) leaseDuration() int {
+	if 0 == spec.LeaseDuration {
+		return INFINITE_LEASE
+	}
+	return spec.LeaseDuration
+}
+
+// Acquires a lease on pageBlob under proposedLeaseId, a new id if empty.
+// Acquiring with the current lease id of an already leased blob succeeds and
+// keeps the lease, so a retry after a lost response does not fail with 409
+func (c *dyskclient) acquireLease(ctx context.Context, pageBlob blobRef, seconds int, proposedLeaseId string) (string, error) {
+	proposedLeaseId, err := proposeLeaseId(proposedLeaseId)
+	if nil != err {
+		return "", err
+	}
+
+	var leaseId string
+	err = c.doAzure(ctx, func() error {
+		var err error
+		leaseId, err = pageBlob.AcquireLease(seconds, proposedLeaseId, nil)
+		return err
+	})
+	return leaseId, err
+}
+
+// leaseId, or a new random (version 4 UUID) lease id if it is empty
+func proposeLeaseId(leaseId string) (string, error) {
+	if 0 < len(leaseId) {
+		return leaseId, nil
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); nil != err {
+		return "", fmt.Errorf("Failed to generate a lease id. Error:%s", err.Error())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rubiojr/go-vhd/vhd"
+)
+
+func newPageBlobTestClient(t *testing.T) (*dyskclient, *fakeBlobBackend) {
+	backend := newFakeBlobBackend(0)
+	c := CreateClient("dyskaccount", "a2V5", WithLogger(NopLogger), withBlobBackend(backend)).(*dyskclient)
+	return c, backend
+}
+
+func TestCreatePageBlob(t *testing.T) {
+	cases := []struct {
+		name      string
+		vhd       bool
+		sizeBytes uint64
+	}{
+		{"page blob", false, BYTES_PER_GB},
+		{"fixed vhd", true, BYTES_PER_GB + vhd.VHD_HEADER_SIZE},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, backend := newPageBlobTestClient(t)
+			res, err := c.CreatePageBlobWithSpec(context.Background(), &PageBlobSpec{
+				Container: "dysks",
+				Name:      "dysk01",
+				SizeBytes: tc.sizeBytes,
+				Vhd:       tc.vhd,
+				LeaseId:   "lease-dysk01",
+			})
+			if nil != err {
+				t.Fatal(err)
+			}
+			if !res.Created || !res.ContainerCreated || "/dysks/dysk01" != res.Path || "lease-dysk01" != res.LeaseId {
+				t.Fatalf("unexpected result %+v", res)
+			}
+
+			stored := backend.blob(res.Path)
+			if nil == stored {
+				t.Fatalf("page blob %s was not created", res.Path)
+			}
+			if int64(tc.sizeBytes) != stored.props.ContentLength {
+				t.Fatalf("expected %d bytes got %d", tc.sizeBytes, stored.props.ContentLength)
+			}
+			if res.LeaseId != stored.leaseId {
+				t.Fatalf("expected the blob to be leased with %s got %q", res.LeaseId, stored.leaseId)
+			}
+			if vhdMetadataValue(tc.vhd) != stored.metadata[vhdMetadataKey] {
+				t.Fatalf("expected vhd metadata %s got %q", vhdMetadataValue(tc.vhd), stored.metadata[vhdMetadataKey])
+			}
+		})
+	}
+}
+
+func TestCreatePageBlobRequireContainer(t *testing.T) {
+	c, backend := newPageBlobTestClient(t)
+	_, err := c.CreatePageBlobWithSpec(context.Background(), &PageBlobSpec{
+		Container:        "missing",
+		Name:             "dysk01",
+		SizeBytes:        BYTES_PER_GB,
+		RequireContainer: true,
+	})
+	if !errors.Is(err, ErrContainerNotFound) {
+		t.Fatalf("expected ErrContainerNotFound got %v", err)
+	}
+	if nil != backend.blob("/missing/dysk01") {
+		t.Fatal("page blob created in a missing container")
+	}
+}
+
+func TestCreatePageBlobIfNotExists(t *testing.T) {
+	c, backend := newPageBlobTestClient(t)
+	backend.addPageBlob("/dysks/dysk01", BYTES_PER_GB, "lease-dysk01")
+	backend.blob("/dysks/dysk01").metadata[vhdMetadataKey] = vhdMetadataValue(false)
+
+	spec := PageBlobSpec{
+		Container:   "dysks",
+		Name:        "dysk01",
+		SizeBytes:   BYTES_PER_GB,
+		IfNotExists: true,
+		LeaseId:     "lease-dysk01",
+	}
+	res, err := c.CreatePageBlobWithSpec(context.Background(), &spec)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if res.Created || "lease-dysk01" != res.LeaseId {
+		t.Fatalf("expected the existing blob to be reused got %+v", res)
+	}
+
+	// leased by someone else
+	spec.LeaseId = "lease-other"
+	if _, err := c.CreatePageBlobWithSpec(context.Background(), &spec); nil == err {
+		t.Fatal("expected a blob leased under a different id to fail")
+	}
+
+	// a different size is never reused
+	spec.LeaseId = "lease-dysk01"
+	spec.SizeBytes = 2 * BYTES_PER_GB
+	if _, err := c.CreatePageBlobWithSpec(context.Background(), &spec); nil == err {
+		t.Fatal("expected a blob of a different size to fail")
+	}
+}
+
+// every blob of a multi blob dysk counts as mounted
+func TestDeletePageBlobMounted(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	d.Paths = []string{"/dysks/dysk01", "/dysks/dysk01b"}
+	d.LeaseIds = []string{"lease-dysk01", "lease-dysk01b"}
+	d.segmentSectors = []uint64{1024, 1024}
+
+	backend := newFakeBlobBackend(0)
+	backend.addPageBlob("/dysks/dysk01b", BYTES_PER_GB, "lease-dysk01b")
+	backend.addPageBlob("/dysks/unmounted", BYTES_PER_GB, "")
+	c := withFakeModule(t, newFakeModule(d), withBlobBackend(backend))
+
+	if err := c.DeletePageBlob("dysks", "dysk01b", true); !errors.Is(err, ErrBlobMounted) {
+		t.Fatalf("expected ErrBlobMounted got %v", err)
+	}
+	if nil == backend.blob("/dysks/dysk01b") {
+		t.Fatal("mounted page blob was deleted")
+	}
+
+	if err := c.DeletePageBlob("dysks", "unmounted", false); nil != err {
+		t.Fatal(err)
+	}
+	if nil != backend.blob("/dysks/unmounted") {
+		t.Fatal("page blob was not deleted")
+	}
+}
+
+// dynamic vhd footers are read back after the write, a lost write is retried
+// once and a creation that never verifies is undone
+func TestCreateDynamicVhdVerify(t *testing.T) {
+	cases := []struct {
+		name       string
+		lostWrites int
+		fail       bool
+	}{
+		{"written", 0, false},
+		{"lost write retried", 1, false},
+		{"never written", 4, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, backend := newPageBlobTestClient(t)
+			backend.lostWrites = tc.lostWrites
+			res, err := c.CreatePageBlobWithSpec(context.Background(), &PageBlobSpec{
+				Container: "dysks",
+				Name:      "dysk01",
+				SizeBytes: BYTES_PER_GB,
+				Vhd:       true,
+				VhdType:   VhdDynamic,
+			})
+			if tc.fail {
+				if !errors.Is(err, ErrInvalidVhd) {
+					t.Fatalf("expected ErrInvalidVhd got %v", err)
+				}
+				if nil != backend.blob("/dysks/dysk01") {
+					t.Fatal("page blob that failed verification was not deleted")
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			stored := backend.blob(res.Path)
+			blobSize := newDynamicVhd(BYTES_PER_GB).blobSize()
+			footer := stored.pages[blobSize-vhd.VHD_HEADER_SIZE]
+			if err := isValidVhdFooter(footer); nil != err {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(footer, stored.pages[0][:vhd.VHD_HEADER_SIZE]) {
+				t.Fatal("expected the footer copy at the start of the blob to match the footer")
+			}
+		})
+	}
+}
+
+// without a caller lease id the blob is leased under a generated one, a lost
+// acquire response is retried and a creation that fails still cleans up
+func TestCreatePageBlobLostLease(t *testing.T) {
+	cases := []struct {
+		name       string
+		lostLeases int
+		fail       bool
+	}{
+		{"retried", 1, false},
+		{"failed", 2, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newFakeBlobBackend(0)
+			backend.lostLeases = tc.lostLeases
+			c := CreateClient("dyskaccount", "a2V5", WithLogger(NopLogger), withBlobBackend(backend), WithRetry(2, time.Millisecond)).(*dyskclient)
+
+			res, err := c.CreatePageBlobWithSpec(context.Background(), &PageBlobSpec{
+				Container: "dysks",
+				Name:      "dysk01",
+				SizeBytes: BYTES_PER_GB,
+			})
+			if tc.fail {
+				if nil == err {
+					t.Fatal("expected the creation to fail")
+				}
+				if nil != backend.blob("/dysks/dysk01") {
+					t.Fatal("leased page blob was left behind")
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+			if 36 != len(res.LeaseId) || res.LeaseId != backend.blob(res.Path).leaseId {
+				t.Fatalf("expected the blob leased under a generated id got %q (blob %q)", res.LeaseId, backend.blob(res.Path).leaseId)
+			}
+		})
+	}
+}
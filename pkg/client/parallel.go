@@ -0,0 +1,39 @@
+package client
+
+import "sync"
+
+// Runs work(idx) for every idx in [0, n) on at most PARALLEL_WORKERS
+// goroutines and waits for all of them
+func parallel(n int, work func(idx int)) {
+	parallelWorkers(n, func() (func(idx int), func()) {
+		return work, func() {}
+	})
+}
+
+// parallel with state per worker (e.g. a device file handle). newWorker is
+// called on each worker's goroutine, release once the worker is done
+func parallelWorkers(n int, newWorker func() (work func(idx int), release func())) {
+	workers := PARALLEL_WORKERS
+	if n < workers {
+		workers = n
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work, release := newWorker()
+			defer release()
+			for idx := range next {
+				work(idx)
+			}
+		}()
+	}
+	for idx := 0; idx < n; idx++ {
+		next <- idx
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Ping checks that a mounted dysk can still reach its page blob. Modules with
+// CapabilityPing do a zero length read against the blob, for older ones the
+// blob properties are read using the dysk's lease instead
+func (c *dyskclient) Ping(name string) (err error) {
+	defer c.observe(OpPing, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	info, err := c.cachedModuleInfo(ctx, f)
+	if nil != err {
+		return err
+	}
+
+	if !info.Has(CapabilityPing) {
+		d, err := c.get(ctx, f, name)
+		if nil != err {
+			return err
+		}
+		return c.pingBlob(ctx, d)
+	}
+
+	// ping request: devicename
+	buffer, err := bufferize(frameName(name), c.ioctlBufferSize)
+	if nil != err {
+		return err
+	}
+	n, e := ioctl(f.Fd(), IOCTLPINGDYSK, buffer)
+	if e != 0 {
+		return &IOCTLError{Cmd: IOCTLPINGDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return err
+	}
+	if res.is_error {
+		return &ModuleResponseError{Response: res.response}
+	}
+	return nil
+}
+
+// reads d's blob properties with its lease, fails if the blob is gone or
+// the lease was lost
+func (c *dyskclient) pingBlob(ctx context.Context, d *Dysk) error {
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		return err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	blobContainer := blobClient.GetContainerReference(containerPath)
+	pageBlob := blobContainer.GetBlobReference(blobName)
+
+	getProps, err := blobPropertiesOptions(d)
+	if nil != err {
+		return err
+	}
+	return c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(getProps)
+	})
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Remount switches a mounted dysk between R and RW in place, the device node
+// and open handles are kept. Going RW to R flushes the device first and fails
+// if I/O is still in flight. Going R to RW leases the blob if the dysk is not
+// leased and checks the lease is held otherwise. Needs a module with
+// CapabilityRemount
+func (c *dyskclient) Remount(name string, newType DyskType) (err error) {
+	defer c.observe(OpRemount, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+	if !newType.Valid() {
+		return fmt.Errorf("Invalid type. Must be R or RW")
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		return err
+	}
+	c.post_get(d)
+
+	if newType == d.Type {
+		return nil
+	}
+	if isMultiBlob(d) {
+		return fmt.Errorf("Can not remount dysk %s, it is backed by several page blobs", name)
+	}
+	if ReadWrite == newType && 0 < len(d.SnapshotTime) {
+		return fmt.Errorf("Invalid type. Snapshots can only be mounted as R")
+	}
+
+	if err := c.requireCapabilities(ctx, f, CapabilityRemount, "Remount"); nil != err {
+		return err
+	}
+
+	// the module keeps the cache mode, it has to suit the new type
+	remounted := *d
+	remounted.Type = newType
+	if 0 == len(remounted.CacheMode) {
+		remounted.CacheMode = CacheModeNone
+	}
+	if err := isValidCacheMode(&remounted); nil != err {
+		return err
+	}
+
+	if ReadOnly == newType {
+		if err := flushDevice(d); nil != err {
+			return err
+		}
+	} else {
+		if 0 == len(d.LeaseId) {
+			// the lease taken for an unleased dysk is not kept if it stays R
+			defer func() {
+				if nil != err && 0 < len(d.LeaseId) {
+					if releaseErr := c.releaseLease(ctx, d); nil != releaseErr {
+						c.logger.Printf("Failed to release lease of dysk %s after failed remount:%s\n", name, releaseErr.Error())
+					}
+				}
+			}()
+		}
+		if err := c.writeLease(ctx, d); nil != err {
+			return err
+		}
+	}
+
+	// remount request: devicename-type-leaseid-leased
+	d.Type = newType
+	buffer, err := bufferize(frameRequest(name, string(newType), d.LeaseId, leasedField(d)), c.ioctlBufferSize)
+	if nil != err {
+		return err
+	}
+	n, e := ioctl(f.Fd(), IOCTLREMOUNTDYSK, buffer)
+	if e != 0 {
+		return &IOCTLError{Cmd: IOCTLREMOUNTDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return err
+	}
+	if res.is_error {
+		return &ModuleResponseError{Response: res.response}
+	}
+	return nil
+}
+
+// writes back d's dirty pages and checks nothing is in flight. The module
+// flushes its own write back cache before it acks the remount
+func flushDevice(d *Dysk) error {
+	devicePath, err := deviceNode(d)
+	if nil != err {
+		return err
+	}
+
+	dev, err := os.OpenFile(devicePath, os.O_RDONLY, 0)
+	if nil != err {
+		return err
+	}
+	defer dev.Close()
+
+	if err := dev.Sync(); nil != err {
+		return fmt.Errorf("Failed to flush dysk %s. Error:%s", d.Name, err.Error())
+	}
+
+	stats, err := readSysBlockStat(d.Name)
+	if nil != err {
+		return err
+	}
+	if 0 < stats.InFlight {
+		return fmt.Errorf("Dysk %s has %d requests in flight, can not remount as R", d.Name, stats.InFlight)
+	}
+	return nil
+}
+
+// how often drainDevice checks in flight requests
+const drainPollInterval = 100 * time.Millisecond
+
+// syncs d (RW dysks only) then waits until it has no requests in flight.
+// Fails with ctx's error if either does not finish in time
+func drainDevice(ctx context.Context, d *Dysk) error {
+	if d.IsReadWrite() {
+		devicePath, err := deviceNode(d)
+		if nil != err {
+			return err
+		}
+		dev, err := os.OpenFile(devicePath, os.O_RDONLY, 0)
+		if nil != err {
+			return err
+		}
+		defer dev.Close()
+
+		// fsync can not be interrupted, it is left running on timeout
+		synced := make(chan error, 1)
+		go func() {
+			synced <- dev.Sync()
+		}()
+		select {
+		case err := <-synced:
+			if nil != err {
+				return fmt.Errorf("Failed to flush dysk %s. Error:%s", d.Name, err.Error())
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		stats, err := readSysBlockStat(d.Name)
+		if nil != err {
+			return err
+		}
+		if 0 == stats.InFlight {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// makes sure d holds a write lease on its blob, acquiring one for unleased dysks
+func (c *dyskclient) writeLease(ctx context.Context, d *Dysk) error {
+	if 0 == len(d.LeaseId) {
+		blobClient, err := c.blobServiceForDysk(d)
+		if nil != err {
+			return err
+		}
+		containerPath, blobName := blobPathParts(d.Path)
+		pageBlob := blobClient.GetContainerReference(containerPath).GetBlobReference(blobName)
+
+		leaseId, err := c.acquireLease(ctx, pageBlob, INFINITE_LEASE, "")
+		if isAzureStatus(err, 409) {
+			return leasedElsewhereError(d)
+		}
+		if nil != err {
+			return err
+		}
+		d.LeaseId = leaseId
+	}
+
+	rw := *d
+	rw.Type = ReadWrite
+	return c.validateLease(ctx, &rw)
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// a lease taken to go RW is released when the remount fails
+func TestRemountReleasesLease(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	d.Type = ReadOnly
+	d.LeaseId = ""
+	m := newFakeModule(d)
+	m.info = &ModuleInfo{Version: "0.2.0", Capabilities: CapabilityRemount, BufferSize: IOCTL_IN_OUT_MAX}
+	backend := newFakeBlobBackend(0)
+	backend.addPageBlob(d.Path, BYTES_PER_GB, "")
+	c := withFakeModule(t, m, withBlobBackend(backend))
+
+	// the fake module does not answer remount IOCTLs
+	if err := c.Remount(d.Name, ReadWrite); !errors.Is(err, ErrIOCTL) {
+		t.Fatalf("expected ErrIOCTL got %v", err)
+	}
+	if leaseId := backend.blob(d.Path).leaseId; 0 < len(leaseId) {
+		t.Fatalf("expected the lease to be released got %s", leaseId)
+	}
+}
+
+// the cache mode is kept across a remount, it must suit the new type
+func TestRemountCacheMode(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	d.CacheMode = CacheModeWriteBack
+	m := newFakeModule(d)
+	m.info = &ModuleInfo{Version: "0.2.0", Capabilities: CapabilityRemount, BufferSize: IOCTL_IN_OUT_MAX}
+	c := withFakeModule(t, m)
+
+	err := c.Remount(d.Name, ReadOnly)
+	if nil == err || !strings.Contains(err.Error(), "cache mode") {
+		t.Fatalf("expected a write back dysk to be refused as R got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Resize grows the page blob backing a mounted dysk to newSizeBytes and
+// makes the kernel pick up the new sector count.
+//
+// Modules that support online resize update the device in place. Older
+// modules (those without CapabilityResize) get the dysk unmounted and
+// mounted again with the new size, the device node is recreated and may
+// come back with a different major/minor. Shrinking is not supported.
+//
+// The module's capabilities are checked before the blob is touched. If the
+// kernel does not take the new size the blob is shrunk back to its old
+// size. When mounting again fails after the unmount the dysk is left
+// unmounted (the error says so), Mount brings it back
+func (c *dyskclient) Resize(name string, newSizeBytes uint64) (err error) {
+	defer c.observe(OpResize, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		return err
+	}
+	c.post_get(d)
+
+	if err := isValidPageBlobSize(newSizeBytes, d.Vhd); nil != err {
+		return err
+	}
+	if VhdDynamic == d.VhdType {
+		return fmt.Errorf("Can not resize dysk %s, dynamic vhds can not be resized", name)
+	}
+	if isMultiBlob(d) {
+		return fmt.Errorf("Can not resize dysk %s, it is backed by several page blobs", name)
+	}
+
+	if newSizeBytes < d.SizeBytes {
+		return fmt.Errorf("Can not shrink dysk %s from %d to %d bytes", name, d.SizeBytes, newSizeBytes)
+	}
+	if newSizeBytes == d.SizeBytes {
+		return nil
+	}
+
+	info, err := c.cachedModuleInfo(ctx, f)
+	if nil != err {
+		return err
+	}
+	online := info.Has(CapabilityResize)
+	if !online {
+		// mounting again needs whatever the dysk was mounted with
+		if err := c.checkMountCapabilities(ctx, f, d); nil != err {
+			return err
+		}
+	}
+
+	oldSizeBytes := d.SizeBytes
+	if err := c.resizePageBlob(ctx, d, newSizeBytes); nil != err {
+		return err
+	}
+
+	computeSize(d, int64(newSizeBytes))
+	if !online {
+		// module can't resize online
+		err = c.remount(ctx, f, d)
+	} else {
+		err = c.resizeDevice(f, name, d.sectorCount)
+	}
+	if nil != err {
+		c.rollbackPageBlobSize(ctx, d, oldSizeBytes)
+		return err
+	}
+	return nil
+}
+
+// tells the module about the new sector count of a mounted dysk
+func (c *dyskclient) resizeDevice(f *deviceHandle, name string, sectorCount uint64) error {
+	// resize request: devicename-sectorcount
+	buffer, err := bufferize(frameRequest(name, strconv.FormatUint(sectorCount, 10)), c.ioctlBufferSize)
+	if nil != err {
+		return err
+	}
+	n, e := ioctl(f.Fd(), IOCTLRESIZEDYSK, buffer)
+	if e != 0 {
+		return &IOCTLError{Cmd: IOCTLRESIZEDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return err
+	}
+	if res.is_error {
+		return &ModuleResponseError{Response: res.response}
+	}
+	return nil
+}
+
+// grows the page blob and moves the vhd footer (if any) to the new end
+func (c *dyskclient) resizePageBlob(ctx context.Context, d *Dysk, newSizeBytes uint64) error {
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		return err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	blobContainer := blobClient.GetContainerReference(containerPath)
+	pageBlob := blobContainer.GetBlobReference(blobName)
+
+	getProps := storage.GetBlobPropertiesOptions{
+		LeaseID: d.LeaseId,
+	}
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(&getProps)
+	})
+	if nil != err {
+		return err
+	}
+
+	if newSizeBytes < uint64(pageBlob.Properties().ContentLength) {
+		return fmt.Errorf("Can not shrink page blob %s from %d to %d bytes", d.Path, pageBlob.Properties().ContentLength, newSizeBytes)
+	}
+
+	pageBlob.Properties().ContentLength = int64(newSizeBytes)
+	setProps := storage.SetBlobPropertiesOptions{
+		LeaseID: d.LeaseId,
+	}
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.SetProperties(&setProps)
+	})
+	if nil != err {
+		return err
+	}
+
+	if d.Vhd {
+		return c.writeVhdFooter(ctx, pageBlob, newSizeBytes, d.LeaseId)
+	}
+	return nil
+}
+
+// Best effort undo of resizePageBlob after the kernel did not take the new
+// size. The old vhd footer is still in place at the old end of the blob,
+// the outcome is only logged
+func (c *dyskclient) rollbackPageBlobSize(ctx context.Context, d *Dysk, oldSizeBytes uint64) {
+	blobClient, err := c.blobServiceForDysk(d)
+	if nil != err {
+		c.logger.Printf("Failed to shrink page blob %s back to %d bytes. Error:%s\n", d.Path, oldSizeBytes, err.Error())
+		return
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	pageBlob := blobClient.GetContainerReference(containerPath).GetBlobReference(blobName)
+
+	// the SDK only sends the new length for a blob it knows is a page blob
+	getProps := storage.GetBlobPropertiesOptions{
+		LeaseID: d.LeaseId,
+	}
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(&getProps)
+	})
+	if nil != err {
+		c.logger.Printf("Failed to shrink page blob %s back to %d bytes. Error:%s\n", d.Path, oldSizeBytes, err.Error())
+		return
+	}
+
+	pageBlob.Properties().ContentLength = int64(oldSizeBytes)
+	setProps := storage.SetBlobPropertiesOptions{
+		LeaseID: d.LeaseId,
+	}
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.SetProperties(&setProps)
+	})
+	if nil != err {
+		c.logger.Printf("Failed to shrink page blob %s back to %d bytes. Error:%s\n", d.Path, oldSizeBytes, err.Error())
+		return
+	}
+	c.logger.Printf("Shrunk page blob %s back to %d bytes\n", d.Path, oldSizeBytes)
+}
+
+// unmounts then mounts d again, sizing it from its page blob
+func (c *dyskclient) remount(ctx context.Context, f *deviceHandle, d *Dysk) error {
+	if err := c.unmount(ctx, f, d.Name); nil != err {
+		return err
+	}
+
+	// a session's handle must be released before mounting borrows it again
+	f.Close()
+
+	d.SizeBytes = 0
+	d.SizeGB = 0
+	if err := c.MountContext(ctx, d); nil != err {
+		return fmt.Errorf("Dysk %s was unmounted and could not be mounted again, it is left unmounted: %w", d.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rubiojr/go-vhd/vhd"
+)
+
+func TestResize(t *testing.T) {
+	const oldSizeBytes = 2048 * DEFAULT_SECTOR_SIZE
+	const newSizeBytes = 2 * oldSizeBytes
+
+	cases := []struct {
+		name      string
+		caps      ModuleCapability
+		cacheMode CacheMode
+		err       error
+		sizeBytes int64 // of the blob after Resize
+	}{
+		// the remount would fail on the cache mode, the blob is left alone
+		{"remount missing capability", 0, CacheModeWriteBack, ErrUnsupportedByModule, oldSizeBytes},
+		// the module fails the resize IOCTL, the blob is shrunk back
+		{"online resize fails", CapabilityResize, "", ErrIOCTL, oldSizeBytes},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := testDysk("dysk01", 1)
+			d.CacheMode = tc.cacheMode
+			m := newFakeModule(d)
+			m.info = &ModuleInfo{Version: "0.2.0", Capabilities: tc.caps, BufferSize: IOCTL_IN_OUT_MAX}
+			backend := newFakeBlobBackend(0)
+			backend.addPageBlob(d.Path, oldSizeBytes, d.LeaseId)
+			c := withFakeModule(t, m, withBlobBackend(backend))
+
+			err := c.Resize(d.Name, newSizeBytes)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v got %v", tc.err, err)
+			}
+			if got := backend.blob(d.Path).props.ContentLength; tc.sizeBytes != got {
+				t.Fatalf("expected a %d bytes blob got %d", tc.sizeBytes, got)
+			}
+		})
+	}
+}
+
+// the new size of a vhd dysk must leave room for its footer
+func TestResizeVhdSize(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	d.Vhd = true
+	c := withFakeModule(t, newFakeModule(d))
+
+	if err := c.Resize(d.Name, vhd.VHD_HEADER_SIZE); nil == err || !strings.Contains(err.Error(), "footer") {
+		t.Fatalf("expected a size without room for the footer to fail got %v", err)
+	}
+}
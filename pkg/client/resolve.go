@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ipFamily4 = "4"
+	ipFamily6 = "6"
+)
+
+// how long a probe connection to a candidate ip may take
+const dialProbeTimeout = 2 * time.Second
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+func (dc *dnsCache) get(host string) ([]net.IPAddr, bool) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	entry, ok := dc.entries[host]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.addrs, true
+}
+
+func (dc *dnsCache) put(host string, addrs []net.IPAddr, ttl time.Duration) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if nil == dc.entries {
+		dc.entries = make(map[string]dnsCacheEntry)
+	}
+	dc.entries[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+}
+
+func (dc *dnsCache) flush() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.entries = nil
+}
+
+// WithIPv6 allows mounting over IPv6 when the storage host has no usable
+// IPv4 address. IPv4 is always preferred. The module must support IPv6
+func WithIPv6() ClientOption {
+	return func(c *dyskclient) {
+		c.allowIPv6 = true
+	}
+}
+
+// WithDNSCacheTTL sets how long resolved storage host addresses are reused
+// across mounts. 0 disables caching. Defaults to 30 seconds
+func WithDNSCacheTTL(ttl time.Duration) ClientOption {
+	return func(c *dyskclient) {
+		if 0 <= ttl {
+			c.dnsCacheTTL = ttl
+		}
+	}
+}
+
+// WithDNSTimeout bounds each storage host lookup. Defaults to 5 seconds
+func WithDNSTimeout(timeout time.Duration) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < timeout {
+			c.dnsTimeout = timeout
+		}
+	}
+}
+
+// FlushDNSCache drops all cached storage host addresses
+func (c *dyskclient) FlushDNSCache() {
+	c.dnsCache.flush()
+}
+
+func (c *dyskclient) lookupHost(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if 0 < c.dnsCacheTTL {
+		if addrs, ok := c.dnsCache.get(host); ok {
+			return addrs, nil
+		}
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, c.dnsTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+	if nil != err {
+		if nil == ctx.Err() && context.DeadlineExceeded == lookupCtx.Err() {
+			return nil, fmt.Errorf("DNS lookup for host:%s timed out after %s", host, c.dnsTimeout)
+		}
+		return nil, fmt.Errorf("DNS lookup for host:%s failed. Error:%s", host, err.Error())
+	}
+	if 0 == len(addrs) {
+		return nil, fmt.Errorf("DNS lookup for host:%s returned no addresses", host)
+	}
+
+	if 0 < c.dnsCacheTTL {
+		c.dnsCache.put(host, addrs, c.dnsCacheTTL)
+	}
+	return addrs, nil
+}
+
+// resolves host and picks the address passed to the kernel module. When
+// there is more than one candidate they are tried in order and the first
+// one accepting connections wins
+func (c *dyskclient) resolveHost(ctx context.Context, host string) (string, error) {
+	// already an address
+	if ip := net.ParseIP(host); nil != ip {
+		if !isUsableIP(ip) || (nil == ip.To4() && !c.allowIPv6) {
+			return "", fmt.Errorf("No usable ip for host:%s (IPv6 allowed:%t)", host, c.allowIPv6)
+		}
+		return ip.String(), nil
+	}
+
+	addrs, err := c.lookupHost(ctx, host)
+	if nil != err {
+		return "", err
+	}
+
+	candidates := candidateIPs(addrs, c.allowIPv6)
+	if 0 == len(candidates) {
+		return "", fmt.Errorf("No usable ip for host:%s out of %d resolved address(es) (IPv6 allowed:%t)", host, len(addrs), c.allowIPv6)
+	}
+	if 1 == len(candidates) {
+		return candidates[0], nil
+	}
+
+	dialer := net.Dialer{Timeout: dialProbeTimeout}
+	for _, ip := range candidates {
+		// the module talks plain http to storage
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, "80"))
+		if nil != err {
+			c.logger.Printf("Storage host %s is not reachable at %s:%s\n", host, ip, err.Error())
+			continue
+		}
+		conn.Close()
+		return ip, nil
+	}
+
+	if err := ctx.Err(); nil != err {
+		return "", err
+	}
+	return "", fmt.Errorf("None of the %d address(es) of host:%s is reachable", len(candidates), host)
+}
+
+func isValidEndpoint(host string, ip string) error {
+	if HOST_LEN <= len(host) || strings.ContainsAny(host, "\n/") {
+		return fmt.Errorf("Invalid host:%s. Must be < %d and a host name", host, HOST_LEN)
+	}
+	parsed := net.ParseIP(ip)
+	if nil == parsed || !isUsableIP(parsed) {
+		return fmt.Errorf("Invalid ip:%s for host:%s", ip, host)
+	}
+	return nil
+}
+
+// usable IPv4 addresses, followed by usable IPv6 ones if allowed
+func candidateIPs(addrs []net.IPAddr, allowIPv6 bool) []string {
+	var candidates []string
+	for _, addr := range addrs {
+		if nil != addr.IP.To4() && isUsableIP(addr.IP) {
+			candidates = append(candidates, addr.IP.String())
+		}
+	}
+
+	if allowIPv6 {
+		for _, addr := range addrs {
+			if nil == addr.IP.To4() && isUsableIP(addr.IP) {
+				candidates = append(candidates, addr.IP.String())
+			}
+		}
+	}
+	return candidates
+}
+
+func isUsableIP(ip net.IP) bool {
+	if nil == ip || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	// has to fit the module's ip field including the terminator
+	return len(ip.String()) < IP_LEN
+}
+
+// family of the ip as passed to the kernel module
+func ipFamily(ip string) string {
+	parsed := net.ParseIP(ip)
+	if nil != parsed && nil == parsed.To4() {
+		return ipFamily6
+	}
+	return ipFamily4
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DyskLayout is how the page blobs of a multi blob dysk make up its device
+type DyskLayout string
+
+const (
+	LayoutConcat DyskLayout = "concat" // blobs back consecutive ranges of the device, in Paths order
+	LayoutStripe DyskLayout = "stripe" // reserved for RAID0 style striping, not supported yet
+)
+
+// most page blobs backing one dysk
+const MAX_SEGMENTS = 16
+
+// true if d is backed by more than one page blob
+func isMultiBlob(d *Dysk) bool {
+	return 1 < len(d.Paths)
+}
+
+// true if blobPath is d's page blob or one of them
+func isBackedBy(d *Dysk, blobPath string) bool {
+	if blobPath == d.Path {
+		return true
+	}
+	for _, p := range d.Paths {
+		if blobPath == p {
+			return true
+		}
+	}
+	return false
+}
+
+// d as if it was backed by its idx'th blob only, for the per blob steps of
+// mounting
+func segmentDysk(d *Dysk, idx int) *Dysk {
+	seg := *d
+	seg.Paths = nil
+	seg.LeaseIds = nil
+	seg.segmentSectors = nil
+	seg.Path = d.Paths[idx]
+	seg.LeaseId = ""
+	if idx < len(d.LeaseIds) {
+		seg.LeaseId = d.LeaseIds[idx]
+	}
+	return &seg
+}
+
+// checks that need no Azure. Path and LeaseId are set to the first blob's
+func (c *dyskclient) isValidSegments(d *Dysk) error {
+	if 0 == len(d.Layout) {
+		d.Layout = LayoutConcat
+	}
+	if LayoutStripe == d.Layout {
+		return fmt.Errorf("Invalid layout %s. Only %s is supported", d.Layout, LayoutConcat)
+	}
+	if LayoutConcat != d.Layout {
+		return fmt.Errorf("Invalid layout %q. Must be %s", d.Layout, LayoutConcat)
+	}
+
+	if MAX_SEGMENTS < len(d.Paths) {
+		return fmt.Errorf("Invalid paths. A dysk can be backed by at most %d page blobs", MAX_SEGMENTS)
+	}
+	if d.Vhd {
+		return fmt.Errorf("Invalid dysk. Dysks backed by several page blobs can not be vhd")
+	}
+	if 0 < len(d.SnapshotTime) {
+		return fmt.Errorf("Invalid dysk. Dysks backed by several page blobs can not mount snapshots")
+	}
+	if 0 < len(d.LeaseIds) && len(d.Paths) != len(d.LeaseIds) {
+		return fmt.Errorf("Invalid lease ids. Expected one per path (%d), got %d", len(d.Paths), len(d.LeaseIds))
+	}
+
+	firstContainer, _ := blobPathParts(d.Paths[0])
+	seen := make(map[string]bool)
+	for idx, blobPath := range d.Paths {
+		if err := isValidBlobPath(blobPath); nil != err {
+			return err
+		}
+		if BLOB_PATH_LEN < len(blobPath) {
+			return fmt.Errorf("Invalid path %s. Must be <= %d", blobPath, BLOB_PATH_LEN)
+		}
+		if seen[blobPath] {
+			return fmt.Errorf("Invalid paths. %s is used more than once", blobPath)
+		}
+		seen[blobPath] = true
+
+		// delegated SAS tokens are scoped to one container
+		if container, _ := blobPathParts(blobPath); nil != c.tokenCredential && container != firstContainer {
+			return fmt.Errorf("Invalid paths. With token credentials all page blobs must be in one container, %s is not in %s", blobPath, firstContainer)
+		}
+		if idx < len(d.LeaseIds) && LEASE_ID_LEN < len(d.LeaseIds[idx]) {
+			return fmt.Errorf("Invalid Lease Id for %s. Must be <= %d", blobPath, LEASE_ID_LEN)
+		}
+	}
+
+	d.Path = d.Paths[0]
+	d.LeaseId = ""
+	if 0 < len(d.LeaseIds) {
+		d.LeaseId = d.LeaseIds[0]
+	}
+	return nil
+}
+
+// sizes every blob, the device is the sum of them
+func (c *dyskclient) set_segment_sizes(ctx context.Context, d *Dysk) error {
+	d.segmentSectors = make([]uint64, len(d.Paths))
+	var sectorCount uint64
+	for idx := range d.Paths {
+		seg := segmentDysk(d, idx)
+		if err := c.set_pageblob_size(ctx, seg); nil != err {
+			return err
+		}
+		if seg.Vhd {
+			return fmt.Errorf("Blob at %s is a vhd, dysks backed by several page blobs can not be vhd", seg.Path)
+		}
+		d.segmentSectors[idx] = seg.sectorCount
+		sectorCount += seg.sectorCount
+	}
+
+	d.sectorCount = sectorCount
+	d.SizeBytes = sectorCount * uint64(d.SectorSize)
+	d.SizeGB = int(d.SizeBytes / BYTES_PER_GB)
+	return nil
+}
+
+// checks type, lease and vhd flag of every blob of d
+func (c *dyskclient) validateLeases(ctx context.Context, d *Dysk) error {
+	if !isMultiBlob(d) {
+		return c.validateLease(ctx, d)
+	}
+
+	for idx := range d.Paths {
+		seg := segmentDysk(d, idx)
+		if seg.IsReadWrite() && 0 == len(seg.LeaseId) {
+			return fmt.Errorf("Invalid Lease Id for %s. RW dysks require a lease on every page blob", seg.Path)
+		}
+		if err := c.validateLease(ctx, seg); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// Segments field: one entry per blob separated by spaces, each
+// path,leaseid,sectorcount with path and lease id query escaped. Empty for
+// single blob dysks
+func segmentsField(d *Dysk) string {
+	if !isMultiBlob(d) {
+		return ""
+	}
+
+	entries := make([]string, len(d.Paths))
+	for idx, blobPath := range d.Paths {
+		var leaseId string
+		if idx < len(d.LeaseIds) {
+			leaseId = d.LeaseIds[idx]
+		}
+		var sectors uint64
+		if idx < len(d.segmentSectors) {
+			sectors = d.segmentSectors[idx]
+		}
+		entries[idx] = fmt.Sprintf("%s,%s,%d", url.QueryEscape(blobPath), url.QueryEscape(leaseId), sectors)
+	}
+	return strings.Join(entries, " ")
+}
+
+// reads back segmentsField, d is left untouched if it does not parse
+func setSegments(d *Dysk, layout string, field string) {
+	if 0 == len(field) {
+		return
+	}
+
+	entries := strings.Split(field, " ")
+	paths := make([]string, len(entries))
+	leaseIds := make([]string, len(entries))
+	sectors := make([]uint64, len(entries))
+	for idx, entry := range entries {
+		parts := strings.Split(entry, ",")
+		if 3 != len(parts) {
+			return
+		}
+		var err error
+		if paths[idx], err = url.QueryUnescape(parts[0]); nil != err {
+			return
+		}
+		if leaseIds[idx], err = url.QueryUnescape(parts[1]); nil != err {
+			return
+		}
+		if sectors[idx], err = strconv.ParseUint(parts[2], 10, 64); nil != err {
+			return
+		}
+	}
+
+	d.Layout = DyskLayout(layout)
+	d.Paths = paths
+	d.LeaseIds = leaseIds
+	d.segmentSectors = sectors
+}
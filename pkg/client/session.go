@@ -0,0 +1,107 @@
+package client
+
+import (
+	"os"
+	"sync"
+)
+
+// handle on the device file. Closing a handle borrowed from a session only
+// releases it, the session keeps the file open. Close is safe to call twice
+type deviceHandle struct {
+	*os.File
+	once    sync.Once
+	release func() error
+}
+
+func (h *deviceHandle) Close() error {
+	var err error
+	h.once.Do(func() {
+		err = h.release()
+	})
+	return err
+}
+
+// Open starts a session, the device file is opened once and shared by all
+// operations until Close. Without a session every operation opens and
+// closes its own handle. Calling Open on an open session is a no-op
+func (c *dyskclient) Open() error {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+
+	if nil != c.session {
+		return nil
+	}
+
+	f, err := c.openFile()
+	if nil != err {
+		return err
+	}
+	c.session = f
+	return nil
+}
+
+// Close ends the session, waiting for in flight operations to finish, and
+// drops the client's blob service and cached user delegation key. Calling it
+// again is a no-op. The client stays usable, the blob service is created
+// again on first use and Open starts a new session. A blob service passed
+// to CreateClientWithBlobService is kept
+func (c *dyskclient) Close() error {
+	// in flight operations finish with the blob service they started with
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+
+	c.blobLock.Lock()
+	if !c.blobServiceInjected {
+		c.blobClient = nil
+	}
+	c.blobLock.Unlock()
+
+	c.delegationKeys.lock.Lock()
+	c.delegationKeys.key = nil
+	c.delegationKeys.lock.Unlock()
+
+	if nil == c.session {
+		return nil
+	}
+
+	err := c.session.Close()
+	c.session = nil
+	return err
+}
+
+// The session's file if one is open (held until the handle is closed),
+// otherwise a handle of its own so concurrent calls never share or close
+// each other's file. Fails if the client's IOCTL buffer size is not the
+// module's
+func (c *dyskclient) openDeviceFile() (*deviceHandle, error) {
+	f, err := c.openDeviceHandle()
+	if nil != err {
+		return nil, err
+	}
+	if err := c.negotiateBufferSize(f); nil != err {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openDeviceFile without the buffer size check
+func (c *dyskclient) openDeviceHandle() (*deviceHandle, error) {
+	c.sessionLock.RLock()
+	if nil != c.session {
+		return &deviceHandle{
+			File: c.session,
+			release: func() error {
+				c.sessionLock.RUnlock()
+				return nil
+			},
+		}, nil
+	}
+	c.sessionLock.RUnlock()
+
+	f, err := c.openFile()
+	if nil != err {
+		return nil, err
+	}
+	return &deviceHandle{File: f, release: f.Close}, nil
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/rubiojr/go-vhd/vhd"
+)
+
+// Bytes of d's blob size that are vhd metadata rather than disk. Fixed vhds
+// end with a footer. Dynamic vhds are sized by their virtual disk size (from
+// the blob metadata), their footer, header and BAT are not part of it
+func vhdOverheadBytes(d *Dysk) uint64 {
+	if !d.Vhd || VhdDynamic == d.VhdType {
+		return 0
+	}
+	return vhd.VHD_HEADER_SIZE
+}
+
+// Sets d's sizes from the size of its page blob (the virtual disk size of
+// dynamic vhds). The sector count the kernel sees excludes the vhd
+// overhead. d.SectorSize must be set
+func computeSize(d *Dysk, contentLength int64) {
+	d.SizeBytes = uint64(contentLength)
+	d.SizeGB = int(d.SizeBytes / BYTES_PER_GB)
+
+	byteSize := d.SizeBytes
+	if overhead := vhdOverheadBytes(d); byteSize >= overhead {
+		byteSize -= overhead
+	}
+	d.sectorCount = byteSize / uint64(d.SectorSize)
+}
+
+// Page blob size of d given its sector count, the inverse of computeSize
+func blobSizeFromSectors(d *Dysk) int64 {
+	return int64(d.sectorCount*uint64(d.SectorSize) + vhdOverheadBytes(d))
+}
+
+// VerifySize compares the size of a mounted dysk as the kernel module sees it
+// with the live size of its page blob, both in page blob bytes (vhd footer
+// included, virtual size for dynamic vhds). They differ when the blob was
+// resized outside of the client, a Resize or remount brings them back in line
+func (c *dyskclient) VerifySize(name string) (kernelBytes uint64, blobBytes uint64, err error) {
+	defer c.observe(OpVerifySize, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return 0, 0, err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		return 0, 0, err
+	}
+	c.post_get(d)
+
+	live := *d
+	if err := c.set_pageblob_size(ctx, &live); nil != err {
+		return 0, 0, err
+	}
+	return d.SizeBytes, live.SizeBytes, nil
+}
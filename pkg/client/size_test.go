@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rubiojr/go-vhd/vhd"
+)
+
+func TestSizeRoundTrip(t *testing.T) {
+	cases := []struct {
+		name       string
+		vhd        bool
+		vhdType    VhdType
+		sectorSize int
+		overhead   int64
+	}{
+		{"page blob", false, "", DEFAULT_SECTOR_SIZE, 0},
+		{"page blob 4k sectors", false, "", 4096, 0},
+		{"fixed vhd", true, VhdFixed, DEFAULT_SECTOR_SIZE, vhd.VHD_HEADER_SIZE},
+		{"dynamic vhd", true, VhdDynamic, DEFAULT_SECTOR_SIZE, 0},
+	}
+	sizesGB := []int64{1, 2, 10, 1023}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, gb := range sizesGB {
+				blobBytes := gb*BYTES_PER_GB + tc.overhead
+				d := &Dysk{Vhd: tc.vhd, VhdType: tc.vhdType, SectorSize: tc.sectorSize}
+
+				computeSize(d, blobBytes)
+				if uint64(gb*BYTES_PER_GB/int64(tc.sectorSize)) != d.sectorCount {
+					t.Fatalf("%dGB: expected %d sectors got %d", gb, gb*BYTES_PER_GB/int64(tc.sectorSize), d.sectorCount)
+				}
+				if int(gb) != d.SizeGB {
+					t.Fatalf("%dGB: expected SizeGB %d got %d", gb, gb, d.SizeGB)
+				}
+				if back := blobSizeFromSectors(d); blobBytes != back {
+					t.Fatalf("%dGB: blob size %d came back as %d", gb, blobBytes, back)
+				}
+			}
+		})
+	}
+}
+
+// the vhd flag recorded on the blob must match the dysk's
+func TestSetPageBlobSizeVhdMismatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata string // "" for blobs without the flag
+		vhd      bool
+		ok       bool
+	}{
+		{"page blob", "0", false, true},
+		{"vhd mounted as page blob", "1", false, false},
+		{"page blob mounted as vhd", "0", true, false},
+		{"no flag", "", false, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, backend := newPageBlobTestClient(t)
+			backend.addPageBlob("/dysks/dysk01", BYTES_PER_GB, "lease-dysk01")
+			if 0 < len(tc.metadata) {
+				backend.blob("/dysks/dysk01").metadata[vhdMetadataKey] = tc.metadata
+			}
+
+			d := testDysk("dysk01", 1)
+			d.Vhd = tc.vhd
+			err := c.set_pageblob_size(context.Background(), d)
+			if tc.ok && nil != err {
+				t.Fatal(err)
+			}
+			if !tc.ok && nil == err {
+				t.Fatal("expected a vhd flag mismatch to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// DyskSpec is one entry of a MountSpec file
+type DyskSpec struct {
+	Name      string
+	Type      DyskType
+	Container string
+	Blob      string
+	LeaseId   string `json:",omitempty"`
+	Vhd       bool
+	SizeGB    int `json:",omitempty"` // optional, the mount fails if the blob is not this size
+}
+
+// MountSpec mounts every dysk described by a JSON array of DyskSpec read from r.
+//
+// The whole file is validated before anything is mounted, if parsing or
+// validation fails nothing is mounted and the errors are returned. Otherwise
+// dysks and errs have one entry per spec: the mounted dysk or the error that
+// prevented mounting it. Names that are already mounted are skipped (their
+// current dysk is returned) so applying the same file again is safe
+func (c *dyskclient) MountSpec(r io.Reader) ([]*Dysk, []error) {
+	var specs []DyskSpec
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&specs); nil != err {
+		return nil, []error{fmt.Errorf("Invalid dysk spec file. Error:%s", err.Error())}
+	}
+
+	var validationErrs []error
+	seen := make(map[string]bool)
+	for idx, spec := range specs {
+		if err := spec.validate(); nil != err {
+			validationErrs = append(validationErrs, fmt.Errorf("Dysk spec #%d (%s): %w", idx, spec.Name, err))
+			continue
+		}
+		if seen[spec.Name] {
+			validationErrs = append(validationErrs, fmt.Errorf("Dysk spec #%d: name %s is used more than once", idx, spec.Name))
+		}
+		seen[spec.Name] = true
+	}
+	if 0 < len(validationErrs) {
+		return nil, validationErrs
+	}
+
+	mounted := make(map[string]*Dysk)
+	existing, err := c.List()
+	if nil != err {
+		return nil, []error{err}
+	}
+	for _, d := range existing {
+		mounted[d.Name] = d
+	}
+
+	dysks := make([]*Dysk, len(specs))
+	errs := make([]error, len(specs))
+	for idx, spec := range specs {
+		if d, ok := mounted[spec.Name]; ok {
+			dysks[idx] = d
+			continue
+		}
+
+		// names were checked against the listing above
+		d := spec.dysk()
+		if err := c.MountWithOptions(context.Background(), d, &MountOptions{SkipNameCheck: true}); nil != err {
+			errs[idx] = err
+			continue
+		}
+		dysks[idx] = d
+	}
+	return dysks, errs
+}
+
+// checks that need no kernel module or Azure
+func (spec *DyskSpec) validate() error {
+	if err := isValidMountName(spec.Name); nil != err {
+		return err
+	}
+	if !spec.Type.Valid() {
+		return fmt.Errorf("Invalid type. Must be R or RW")
+	}
+	if 0 == len(spec.Container) || 0 == len(spec.Blob) {
+		return fmt.Errorf("Container and blob are required")
+	}
+	if ReadWrite == spec.Type && 0 == len(spec.LeaseId) {
+		return fmt.Errorf("Lease id is required for RW dysks")
+	}
+	if 0 > spec.SizeGB {
+		return fmt.Errorf("Invalid size:%d", spec.SizeGB)
+	}
+	return nil
+}
+
+func (spec *DyskSpec) dysk() *Dysk {
+	return &Dysk{
+		Type:           spec.Type,
+		Name:           spec.Name,
+		Path:           "/" + spec.Container + "/" + spec.Blob,
+		LeaseId:        spec.LeaseId,
+		Vhd:            spec.Vhd,
+		declaredSizeGB: spec.SizeGB,
+	}
+}
+
+// Reconcile compares the desired dysks against the mounted ones and reports
+// what has to be mounted and unmounted, without changing anything. Dysks are
+// matched by name, a mounted dysk whose type, path or size drifted from the
+// desired one is in both lists
+func (c *dyskclient) Reconcile(spec []*Dysk) ([]*Dysk, []*Dysk, error) {
+	live, err := c.List()
+	if nil != err {
+		return nil, nil, err
+	}
+	toMount, toUnmount := diffDysks(spec, live)
+	return toMount, toUnmount, nil
+}
+
+func diffDysks(desired []*Dysk, live []*Dysk) (toMount []*Dysk, toUnmount []*Dysk) {
+	liveByName := make(map[string]*Dysk, len(live))
+	for _, d := range live {
+		liveByName[d.Name] = d
+	}
+
+	desiredNames := make(map[string]bool, len(desired))
+	for _, want := range desired {
+		desiredNames[want.Name] = true
+
+		have, ok := liveByName[want.Name]
+		if !ok {
+			toMount = append(toMount, want)
+			continue
+		}
+		if dysksDrifted(want, have) {
+			toUnmount = append(toUnmount, have)
+			toMount = append(toMount, want)
+		}
+	}
+
+	for _, have := range live {
+		if !desiredNames[have.Name] {
+			toUnmount = append(toUnmount, have)
+		}
+	}
+	return toMount, toUnmount
+}
+
+// size is only compared if the desired dysk has one
+func dysksDrifted(want *Dysk, have *Dysk) bool {
+	if want.Type != have.Type || want.Path != have.Path {
+		return true
+	}
+	if 0 != want.SizeBytes {
+		return want.SizeBytes != have.SizeBytes
+	}
+	if 0 != want.SizeGB {
+		return want.SizeGB != have.SizeGB
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a declared size must match the blob, 0 takes the blob's size
+func TestMountSpecSize(t *testing.T) {
+	cases := []struct {
+		name   string
+		sizeGB int
+		fail   bool
+	}{
+		{"from blob", 0, false},
+		{"matches", 1, false},
+		{"differs", 2, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newFakeBlobBackend(0)
+			backend.addPageBlob("/dysks/dysk01", BYTES_PER_GB, "lease-dysk01")
+			m := newFakeModule()
+			m.mountResponse = "OK\n" + getResponse(testDysk("dysk01", 1))
+			c := withFakeModule(t, m, withBlobBackend(backend), WithDNSCacheTTL(time.Minute))
+			c.storageAccountKey = "a2V5"
+			// spec dysks are resolved, the cached address keeps DNS out of it
+			c.dnsCache.put("dyskaccount.blob.core.windows.net", []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, time.Minute)
+
+			spec := `[{"Name":"dysk01","Type":"RW","Container":"dysks","Blob":"dysk01","LeaseId":"lease-dysk01","Vhd":false,"SizeGB":` + strconv.Itoa(tc.sizeGB) + `}]`
+			dysks, errs := c.MountSpec(strings.NewReader(spec))
+			if 1 != len(errs) {
+				t.Fatalf("expected one result got %v", errs)
+			}
+			if tc.fail {
+				if nil == errs[0] || !strings.Contains(errs[0].Error(), "declares 2 GB") {
+					t.Fatalf("expected a size mismatch got %v", errs[0])
+				}
+				return
+			}
+			if nil != errs[0] {
+				t.Fatal(errs[0])
+			}
+			if 1 != dysks[0].SizeGB {
+				t.Fatalf("expected a 1 GB dysk got %d", dysks[0].SizeGB)
+			}
+		})
+	}
+}
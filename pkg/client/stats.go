@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// block layer statistics, one directory per disk
+const sysBlockPath = "/sys/block"
+
+// DyskStats are I/O counters of a mounted dysk, cumulative since it was
+// mounted (counters restart when the dysk is unmounted and mounted again)
+type DyskStats struct {
+	Reads      uint64 // completed read requests
+	Writes     uint64 // completed write requests
+	ReadBytes  uint64
+	WriteBytes uint64
+	InFlight   uint64 // requests issued but not yet completed
+	IOTicksMs  uint64 // time the device had I/O in flight
+	// Failed requests, the block layer does not count them so they are only
+	// reported by modules with CapabilityStats and are zero otherwise
+	ReadErrors  uint64
+	WriteErrors uint64
+}
+
+// Stats reads the I/O counters of a mounted dysk from /sys/block/<name>/stat
+// and, if the module supports it, its error counters
+func (c *dyskclient) Stats(name string) (_ *DyskStats, err error) {
+	defer c.observe(OpStats, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return nil, err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	// make sure it is a dysk and not some other disk
+	if _, err := c.get(ctx, f, name); nil != err {
+		return nil, err
+	}
+	return c.stats(ctx, f, name)
+}
+
+// ListStats reads the stats of every mounted dysk, keyed by name
+func (c *dyskclient) ListStats() (_ map[string]*DyskStats, err error) {
+	defer c.observe(OpStats, time.Now(), &err)
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	names, err := c.listNames(ctx, f)
+	if nil != err {
+		return nil, err
+	}
+
+	all := make(map[string]*DyskStats, len(names))
+	for _, name := range names {
+		stats, err := c.stats(ctx, f, name)
+		if nil != err {
+			return nil, err
+		}
+		all[name] = stats
+	}
+	return all, nil
+}
+
+func (c *dyskclient) stats(ctx context.Context, f *deviceHandle, name string) (*DyskStats, error) {
+	stats, err := readSysBlockStat(name)
+	if nil != err {
+		return nil, err
+	}
+
+	info, err := c.cachedModuleInfo(ctx, f)
+	if nil != err {
+		return nil, err
+	}
+	if !info.Has(CapabilityStats) {
+		return stats, nil
+	}
+
+	// stats request: devicename
+	buffer, err := bufferize(frameName(name), c.ioctlBufferSize)
+	if nil != err {
+		return nil, err
+	}
+	n, e := ioctl(f.Fd(), IOCTLSTATSDYSK, buffer)
+	if e != 0 {
+		return nil, &IOCTLError{Cmd: IOCTLSTATSDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return nil, err
+	}
+	if res.is_error {
+		return nil, &ModuleResponseError{Response: res.response}
+	}
+
+	// readerrors-writeerrors
+	split := strings.Split(res.response, "\n")
+	if 2 > len(split) {
+		return nil, fmt.Errorf("Invalid stats response for dysk %s:%q", name, res.response)
+	}
+	if stats.ReadErrors, err = strconv.ParseUint(split[0], 10, 64); nil != err {
+		return nil, fmt.Errorf("Invalid read error count for dysk %s:%s", name, split[0])
+	}
+	if stats.WriteErrors, err = strconv.ParseUint(split[1], 10, 64); nil != err {
+		return nil, fmt.Errorf("Invalid write error count for dysk %s:%s", name, split[1])
+	}
+	return stats, nil
+}
+
+// see Documentation/block/stat.txt, sectors there are always 512 bytes
+func readSysBlockStat(name string) (*DyskStats, error) {
+	statFile := path.Join(sysBlockPath, name, "stat")
+	content, err := ioutil.ReadFile(statFile)
+	if nil != err {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(content))
+	if 11 > len(fields) {
+		return nil, fmt.Errorf("Invalid block stat file %s:%q", statFile, string(content))
+	}
+
+	values := make([]uint64, 11)
+	for idx := range values {
+		values[idx], err = strconv.ParseUint(fields[idx], 10, 64)
+		if nil != err {
+			return nil, fmt.Errorf("Invalid block stat file %s:%q", statFile, string(content))
+		}
+	}
+
+	// reads merges sectors ticks writes merges sectors ticks inflight ioticks queueticks
+	return &DyskStats{
+		Reads:      values[0],
+		ReadBytes:  values[2] * 512,
+		Writes:     values[4],
+		WriteBytes: values[6] * 512,
+		InFlight:   values[8],
+		IOTicksMs:  values[9],
+	}, nil
+}
@@ -0,0 +1,407 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// Token credentials (Azure AD: managed identity, service principal..)
+//
+// The client's own blob requests carry a bearer token fetched from the
+// credential on every request, the credential is expected to cache and
+// refresh tokens itself (azidentity credentials do).
+//
+// The kernel module only knows shared keys and SAS tokens, so on mount the
+// client asks Azure for a user delegation key and signs a SAS scoped to the
+// dysk's container (r for R dysks, rw for RW dysks) with it. The SAS is valid
+// for the client's delegated SAS lifetime (DEFAULT_DELEGATED_SAS_LIFETIME
+// unless set with WithDelegatedSASLifetime). Dysks that stay mounted longer
+// must get a fresh SAS before it expires with RefreshCredentials, e.g. every
+// half lifetime, or their I/O starts failing once it does. The identity needs
+// a role allowing it to read/write blobs and to get a user delegation key
+// (e.g. Storage Blob Data Contributor)
+
+const (
+	// scope of tokens for Azure Storage
+	storageTokenScope = "https://storage.azure.com/.default"
+	// service version used for user delegation keys and the SAS signed with them
+	delegationVersion    = "2020-02-10"
+	delegationTimeFormat = "2006-01-02T15:04:05Z"
+	// the kernel module may talk plain http
+	delegationProtocols = "https,http"
+	// Azure's limit on user delegation key lifetime
+	maxDelegationKeyLifetime = 7 * 24 * time.Hour
+	// SAS start is back dated this much for clock skew
+	delegationClockSkew = 5 * time.Minute
+)
+
+// CreateClientWithTokenCredential creates a client that authenticates with
+// Azure AD tokens from cred (e.g. an azidentity credential) instead of an
+// account key. Mounted dysks get a user delegation SAS, see
+// RefreshCredentials for keeping it valid
+func CreateClientWithTokenCredential(account string, cred azcore.TokenCredential, opts ...ClientOption) DyskClient {
+	return CreateClient(account, "", append(opts, WithTokenCredential(cred))...)
+}
+
+// WithTokenCredential makes a client created without an account key
+// authenticate with Azure AD tokens from cred, see
+// CreateClientWithTokenCredential
+func WithTokenCredential(cred azcore.TokenCredential) ClientOption {
+	return func(c *dyskclient) {
+		c.tokenCredential = cred
+	}
+}
+
+// WithDelegatedSASLifetime sets how long the SAS handed to the kernel module
+// by token credential clients is valid, at most 7 days
+func WithDelegatedSASLifetime(lifetime time.Duration) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < lifetime && maxDelegationKeyLifetime >= lifetime+delegationClockSkew {
+			c.delegatedSASLifetime = lifetime
+		}
+	}
+}
+
+// adds a bearer token from cred to every request
+type bearerTransport struct {
+	cred azcore.TokenCredential
+	base http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.cred.GetToken(req.Context(), policy.TokenRequestOptions{Scopes: []string{storageTokenScope}})
+	if nil != err {
+		return nil, fmt.Errorf("Failed to get a token for Azure Storage. Error:%s", err.Error())
+	}
+
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+token.Token)
+	return t.base.RoundTrip(authorized)
+}
+
+// http client sending bearer tokens, on top of the blob http client
+func (c *dyskclient) bearerHTTPClient() (*http.Client, error) {
+	httpClient := &http.Client{}
+	base, err := c.blobHTTPClient()
+	if nil != err {
+		return nil, err
+	}
+	if nil != base {
+		*httpClient = *base
+	}
+
+	transport := httpClient.Transport
+	if nil == transport {
+		transport = http.DefaultTransport
+	}
+	httpClient.Transport = &bearerTransport{cred: c.tokenCredential, base: transport}
+	return httpClient, nil
+}
+
+// user delegation key as returned by Azure
+type userDelegationKey struct {
+	SignedOid     string `xml:"SignedOid"`
+	SignedTid     string `xml:"SignedTid"`
+	SignedStart   string `xml:"SignedStart"`
+	SignedExpiry  string `xml:"SignedExpiry"`
+	SignedService string `xml:"SignedService"`
+	SignedVersion string `xml:"SignedVersion"`
+	Value         string `xml:"Value"`
+
+	expiry time.Time
+}
+
+// the client's current user delegation key, replaced when it can no longer
+// sign a SAS of the full lifetime
+type delegationKeyCache struct {
+	lock sync.Mutex
+	key  *userDelegationKey
+}
+
+func (c *dyskclient) delegationKey(ctx context.Context, validUntil time.Time) (*userDelegationKey, error) {
+	c.delegationKeys.lock.Lock()
+	defer c.delegationKeys.lock.Unlock()
+
+	if key := c.delegationKeys.key; nil != key && key.expiry.After(validUntil) {
+		return key, nil
+	}
+
+	key, err := c.getUserDelegationKey(ctx)
+	if nil != err {
+		return nil, err
+	}
+	c.delegationKeys.key = key
+	return key, nil
+}
+
+// asks Azure for a user delegation key valid for the longest time allowed
+func (c *dyskclient) getUserDelegationKey(ctx context.Context) (*userDelegationKey, error) {
+	if c.emulator {
+		return nil, fmt.Errorf("Token credentials are not supported by the storage emulator")
+	}
+
+	httpClient, err := c.bearerHTTPClient()
+	if nil != err {
+		return nil, err
+	}
+
+	start := time.Now().UTC().Add(-delegationClockSkew)
+	expiry := start.Add(maxDelegationKeyLifetime)
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?><KeyInfo><Start>%s</Start><Expiry>%s</Expiry></KeyInfo>`, start.Format(delegationTimeFormat), expiry.Format(delegationTimeFormat))
+
+	scheme := "https"
+	if !c.useHTTPS {
+		scheme = "http"
+	}
+	keyURL := fmt.Sprintf("%s://%s/?restype=service&comp=userdelegationkey", scheme, c.blobHost(c.storageAccountName))
+
+	var key userDelegationKey
+	err = c.doAzure(ctx, func() error {
+		req, err := http.NewRequest(http.MethodPost, keyURL, bytes.NewBufferString(body))
+		if nil != err {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("x-ms-version", delegationVersion)
+		req.Header.Set("Content-Type", "application/xml")
+		req.Header.Set("User-Agent", c.userAgent)
+
+		res, err := httpClient.Do(req)
+		if nil != err {
+			return err
+		}
+		defer res.Body.Close()
+
+		resBody, err := ioutil.ReadAll(res.Body)
+		if nil != err {
+			return err
+		}
+		if http.StatusOK != res.StatusCode {
+			return fmt.Errorf("Failed to get a user delegation key, status:%d. Response:%s", res.StatusCode, string(resBody))
+		}
+		return xml.Unmarshal(resBody, &key)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	key.expiry, err = time.Parse(time.RFC3339, key.SignedExpiry)
+	if nil != err {
+		return nil, fmt.Errorf("Invalid user delegation key expiry %q. Error:%s", key.SignedExpiry, err.Error())
+	}
+	return &key, nil
+}
+
+// SAS for the kernel module on d's container, signed with a user delegation key
+func (c *dyskclient) delegatedSAS(ctx context.Context, d *Dysk) (string, error) {
+	start := time.Now().UTC().Add(-delegationClockSkew)
+	expiry := time.Now().UTC().Add(c.delegatedSASLifetime)
+
+	key, err := c.delegationKey(ctx, expiry)
+	if nil != err {
+		return "", err
+	}
+
+	permissions := "r"
+	if d.IsReadWrite() {
+		permissions = "rw"
+	}
+	container, _ := blobPathParts(d.Path)
+
+	return signDelegatedSAS(key, c.storageAccountName, container, permissions, start, expiry)
+}
+
+// container SAS, see "Create a user delegation SAS" in the Azure Storage docs
+func signDelegatedSAS(key *userDelegationKey, account string, container string, permissions string, start time.Time, expiry time.Time) (string, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key.Value)
+	if nil != err {
+		return "", fmt.Errorf("Invalid user delegation key. Error:%s", err.Error())
+	}
+
+	signedStart := start.Format(delegationTimeFormat)
+	signedExpiry := expiry.Format(delegationTimeFormat)
+	stringToSign := strings.Join([]string{
+		permissions,
+		signedStart,
+		signedExpiry,
+		"/blob/" + account + "/" + container,
+		key.SignedOid,
+		key.SignedTid,
+		key.SignedStart,
+		key.SignedExpiry,
+		key.SignedService,
+		key.SignedVersion,
+		"", // authorized user object id
+		"", // unauthorized user object id
+		"", // correlation id
+		"", // ip
+		delegationProtocols,
+		delegationVersion,
+		"c",
+		"", // snapshot time
+		"", // cache control
+		"", // content disposition
+		"", // content encoding
+		"", // content language
+		"", // content type
+	}, "\n")
+
+	mac := hmac.New(sha256.New, keyBytes)
+	mac.Write([]byte(stringToSign))
+
+	sas := url.Values{}
+	sas.Set("sv", delegationVersion)
+	sas.Set("sr", "c")
+	sas.Set("sp", permissions)
+	sas.Set("st", signedStart)
+	sas.Set("se", signedExpiry)
+	sas.Set("spr", delegationProtocols)
+	sas.Set("skoid", key.SignedOid)
+	sas.Set("sktid", key.SignedTid)
+	sas.Set("skt", key.SignedStart)
+	sas.Set("ske", key.SignedExpiry)
+	sas.Set("sks", key.SignedService)
+	sas.Set("skv", key.SignedVersion)
+	sas.Set("sig", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return sas.Encode(), nil
+}
+
+// RefreshCredentials hands a mounted dysk a fresh SAS: a new user delegation
+// SAS for token credential clients, the client's SAS token for SAS clients.
+// Needs a module with CapabilityAuthUpdate
+func (c *dyskclient) RefreshCredentials(name string) (err error) {
+	defer c.observe(OpUpdateAuth, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		return err
+	}
+	if d.AccountName != c.storageAccountName {
+		return fmt.Errorf("Dysk %s is on account %s, the client is for %s", name, d.AccountName, c.storageAccountName)
+	}
+
+	var sas string
+	switch {
+	case nil != c.tokenCredential:
+		if sas, err = c.delegatedSAS(ctx, d); nil != err {
+			return fmt.Errorf("Failed to create a SAS for %s. Error:%s", d.Path, err.Error())
+		}
+	case 0 < len(c.sasToken):
+		sas = c.sasToken
+	default:
+		return fmt.Errorf("Client has no SAS token or token credential to refresh dysk %s with", name)
+	}
+
+	if err := c.requireCapabilities(ctx, f, CapabilityAuthUpdate, "Credential refresh"); nil != err {
+		return err
+	}
+	return c.updateAuth(f, name, sas, "")
+}
+
+// RotateKey hands a mounted dysk a new account key, e.g. when the storage
+// account's keys are rotated. The key is checked against the dysk's blob
+// before the module gets it. Needs a module with CapabilityAuthUpdate and
+// CapabilityKeyUpdate, otherwise the error matches ErrUnsupportedByModule and
+// the dysk has to be mounted again. The client keeps its own key
+func (c *dyskclient) RotateKey(name string, newKey string) (err error) {
+	defer c.observe(OpUpdateAuth, time.Now(), &err)
+	if err := ValidateDeviceName(name); nil != err {
+		return err
+	}
+	if 0 == len(newKey) || ACCOUNT_KEY_LEN < len(newKey) {
+		return fmt.Errorf("Invalid AccountKey. Must be <= %d", ACCOUNT_KEY_LEN)
+	}
+	if _, err := base64.StdEncoding.DecodeString(newKey); nil != err {
+		return fmt.Errorf("Invalid account key. Must be a base64 encoded string. Error:%s", err.Error())
+	}
+
+	f, err := c.openDeviceFile()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	d, err := c.get(ctx, f, name)
+	if nil != err {
+		return err
+	}
+	if 0 < len(d.SASToken) {
+		return fmt.Errorf("Dysk %s authenticates with a SAS token, use RefreshCredentials", name)
+	}
+
+	if err := c.requireCapabilities(ctx, f, CapabilityAuthUpdate|CapabilityKeyUpdate, "Account key rotation"); nil != err {
+		return err
+	}
+
+	// the blob must be readable with the new key
+	blobClient, err := c.newBackend(d.AccountName, newKey, "")
+	if nil != err {
+		return err
+	}
+	containerPath, blobName := blobPathParts(d.Path)
+	pageBlob := blobClient.GetContainerReference(containerPath).GetBlobReference(blobName)
+	err = c.doAzure(ctx, func() error {
+		return pageBlob.GetProperties(nil)
+	})
+	if nil != err {
+		return fmt.Errorf("Failed to read %s with the new account key. Error:%s", d.Path, err.Error())
+	}
+
+	if err := c.updateAuth(f, name, "", newKey); nil != err {
+		return err
+	}
+	d.AccountKey = newKey
+	return nil
+}
+
+// auth update request: devicename-sastoken-accountkey, one of the two set.
+// The account key line is only sent for key updates, older modules read
+// the SAS token alone
+func (c *dyskclient) updateAuth(f *deviceHandle, name string, sas string, key string) error {
+	request := frameRequest(name, sas)
+	if 0 < len(key) {
+		request = frameRequest(name, sas, key)
+	}
+	buffer, err := bufferize(request, c.ioctlBufferSize)
+	if nil != err {
+		return err
+	}
+	n, e := ioctl(f.Fd(), IOCTLAUTHUPDATEDYSK, buffer)
+	if e != 0 {
+		return &IOCTLError{Cmd: IOCTLAUTHUPDATEDYSK, Errno: e}
+	}
+
+	res, err := parseResponse(buffer[:n])
+	if nil != err {
+		return err
+	}
+	if res.is_error {
+		return &ModuleResponseError{Response: res.response}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+type fakeTokenCredential struct {
+	scopes []string
+}
+
+func (cred *fakeTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	cred.scopes = options.Scopes
+	return azcore.AccessToken{Token: "fake-token"}, nil
+}
+
+// an azcore credential is used as is for the client's blob requests
+func TestTokenCredentialBearer(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	cred := &fakeTokenCredential{}
+	c := CreateClientWithTokenCredential("dyskaccount", cred).(*dyskclient)
+	httpClient, err := c.bearerHTTPClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+	res, err := httpClient.Get(server.URL)
+	if nil != err {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if "Bearer fake-token" != authorization {
+		t.Fatalf("expected the credential's token got %q", authorization)
+	}
+	if 1 != len(cred.scopes) || storageTokenScope != cred.scopes[0] {
+		t.Fatalf("expected a token for %s got %v", storageTokenScope, cred.scopes)
+	}
+}
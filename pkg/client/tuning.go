@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+)
+
+// 0 (the default) leaves the kernel defaults alone
+func isValidQueueTuning(d *Dysk) error {
+	if 0 != d.ReadAheadKB && MAX_READ_AHEAD_KB < d.ReadAheadKB {
+		return fmt.Errorf("Invalid read ahead:%dKB. Must be <= %d", d.ReadAheadKB, MAX_READ_AHEAD_KB)
+	}
+	if 0 != d.QueueDepth && (MIN_QUEUE_DEPTH > d.QueueDepth || MAX_QUEUE_DEPTH < d.QueueDepth) {
+		return fmt.Errorf("Invalid queue depth:%d. Must be between %d and %d", d.QueueDepth, MIN_QUEUE_DEPTH, MAX_QUEUE_DEPTH)
+	}
+	return nil
+}
+
+// Modules with CapabilityQueueTuning apply read ahead and queue depth on
+// mount. For older ones they are set through /sys/block once the dysk is mounted
+func (c *dyskclient) applyQueueTuning(ctx context.Context, f *deviceHandle, d *Dysk) error {
+	if 0 == d.ReadAheadKB && 0 == d.QueueDepth {
+		return nil
+	}
+
+	info, err := c.cachedModuleInfo(ctx, f)
+	if nil != err {
+		return err
+	}
+	if info.Has(CapabilityQueueTuning) {
+		return nil
+	}
+
+	queuePath := path.Join(sysBlockPath, d.Name, "queue")
+	if 0 != d.ReadAheadKB {
+		if err := ioutil.WriteFile(path.Join(queuePath, "read_ahead_kb"), []byte(strconv.Itoa(d.ReadAheadKB)), 0644); nil != err {
+			return err
+		}
+	}
+	if 0 != d.QueueDepth {
+		if err := ioutil.WriteFile(path.Join(queuePath, "nr_requests"), []byte(strconv.Itoa(d.QueueDepth)), 0644); nil != err {
+			return err
+		}
+	}
+	return nil
+}
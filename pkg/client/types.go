@@ -1,5 +1,10 @@
 package client
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 type DyskType string
 
 const (
@@ -7,18 +12,238 @@ const (
 	ReadWrite DyskType = "RW"
 )
 
+// Valid is true for R and RW
+func (t DyskType) Valid() bool {
+	return ReadOnly == t || ReadWrite == t
+}
+
+// CacheMode is the module's caching of blob pages for a dysk
+type CacheMode string
+
+const (
+	CacheModeNone         CacheMode = "none"
+	CacheModeRead         CacheMode = "read"         // read only dysks
+	CacheModeWriteThrough CacheMode = "writethrough" // writes complete once on the blob
+	CacheModeWriteBack    CacheMode = "writeback"    // writes complete once cached, may be lost on crash
+)
+
 type Dysk struct {
-	Type        DyskType
-	Name        string
-	sectorCount uint64
-	AccountName string
-	AccountKey  string
-	Path        string
-	host        string
-	ip          string
-	LeaseId     string
-	Major       int
-	Minor       int
-	Vhd         bool
-	SizeGB      int
+	Type         DyskType
+	Name         string
+	sectorCount  uint64
+	AccountName  string
+	AccountKey   string
+	SASToken     string
+	Path         string
+	SnapshotTime string // e.g. 2017-11-01T12:00:00.0000000Z, snapshot dysks are read only
+	host         string
+	ip           string
+	LeaseId      string
+	Major        int
+	Minor        int
+	Vhd          bool
+	SizeGB       int
+	SizeBytes    uint64
+	SectorSize   int       // bytes, defaults to 512
+	ReadAheadKB  int       // 0 keeps the kernel default (128), max 32768
+	QueueDepth   int       // 0 keeps the kernel default (128), 4 to 4096
+	CacheMode    CacheMode // defaults to none
+	VhdType      VhdType   // fixed or dynamic, read from the blob on mount
+	// Paths, when more than one, are the page blobs backing the dysk, put
+	// together as Layout says (concat by default). LeaseIds are their leases in
+	// the same order, required for RW. Path and LeaseId are set to the first
+	// blob's on mount
+	Paths          []string
+	LeaseIds       []string
+	Layout         DyskLayout
+	segmentSectors []uint64
+	// size a MountSpec entry declared, mount fails if the blob differs
+	declaredSizeGB int
+}
+
+// SetResolvedEndpoint sets the storage host and ip the kernel module
+// connects to, for networks where DNS resolution from this host gives an
+// unreachable address. When both are set mounting skips resolution entirely
+// and uses them as is
+func (d *Dysk) SetResolvedEndpoint(host string, ip string) {
+	d.host = host
+	d.ip = ip
+}
+
+// Host is the storage host name passed to the kernel module
+func (d *Dysk) Host() string {
+	return d.host
+}
+
+// IP is the storage host address passed to the kernel module
+func (d *Dysk) IP() string {
+	return d.ip
+}
+
+// IsReadOnly is true for dysks mounted R
+func (d *Dysk) IsReadOnly() bool {
+	return ReadOnly == d.Type
+}
+
+// IsReadWrite is true for dysks mounted RW
+func (d *Dysk) IsReadWrite() bool {
+	return ReadWrite == d.Type
+}
+
+// SectorCount is the size of the device in SectorSize sectors, vhd footer
+// excluded. Set by Get, List and Mount, the exact size in bytes of the blob
+// is in SizeBytes
+func (d *Dysk) SectorCount() uint64 {
+	return d.sectorCount
+}
+
+// SetBlob points d at the page blob name in container
+func (d *Dysk) SetBlob(container string, name string) {
+	d.Path = "/" + container + "/" + name
+}
+
+// Container is the container of the page blob d.Path points at
+func (d *Dysk) Container() (string, error) {
+	if err := isValidBlobPath(d.Path); nil != err {
+		return "", err
+	}
+	container, _ := blobPathParts(d.Path)
+	return container, nil
+}
+
+// BlobName is the name of the page blob d.Path points at, within its
+// container. It may contain /
+func (d *Dysk) BlobName() (string, error) {
+	if err := isValidBlobPath(d.Path); nil != err {
+		return "", err
+	}
+	_, name := blobPathParts(d.Path)
+	return name, nil
+}
+
+// /container/blob, the blob name may have / of its own. blobPath is
+// expected to be valid (isValidBlobPath)
+func blobPathParts(blobPath string) (container string, name string) {
+	parts := strings.SplitN(strings.TrimPrefix(blobPath, "/"), "/", 2)
+	if 2 > len(parts) {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// wire shape of a Dysk, field names are kept stable
+type dyskJSON struct {
+	Type         DyskType
+	Name         string
+	SectorCount  uint64
+	AccountName  string
+	AccountKey   string `json:",omitempty"`
+	SASToken     string `json:",omitempty"`
+	Path         string
+	SnapshotTime string `json:",omitempty"`
+	Host         string `json:",omitempty"`
+	IP           string `json:",omitempty"`
+	LeaseId      string
+	Major        int
+	Minor        int
+	Vhd          bool
+	SizeGB       int
+	SizeBytes    uint64
+	SectorSize   int
+	ReadAheadKB  int        `json:",omitempty"`
+	QueueDepth   int        `json:",omitempty"`
+	CacheMode    CacheMode  `json:",omitempty"`
+	VhdType      VhdType    `json:",omitempty"`
+	Paths        []string   `json:",omitempty"`
+	LeaseIds     []string   `json:",omitempty"`
+	Layout       DyskLayout `json:",omitempty"`
+}
+
+func (d *Dysk) toJSON(withSecrets bool) *dyskJSON {
+	j := &dyskJSON{
+		Type:         d.Type,
+		Name:         d.Name,
+		SectorCount:  d.sectorCount,
+		AccountName:  d.AccountName,
+		Path:         d.Path,
+		SnapshotTime: d.SnapshotTime,
+		Host:         d.host,
+		IP:           d.ip,
+		LeaseId:      d.LeaseId,
+		Major:        d.Major,
+		Minor:        d.Minor,
+		Vhd:          d.Vhd,
+		SizeGB:       d.SizeGB,
+		SizeBytes:    d.SizeBytes,
+		SectorSize:   d.SectorSize,
+		ReadAheadKB:  d.ReadAheadKB,
+		QueueDepth:   d.QueueDepth,
+		CacheMode:    d.CacheMode,
+		VhdType:      d.VhdType,
+		Paths:        d.Paths,
+		LeaseIds:     d.LeaseIds,
+		Layout:       d.Layout,
+	}
+	if withSecrets {
+		j.AccountKey = d.AccountKey
+		j.SASToken = d.SASToken
+		return j
+	}
+	// masked the same way as in debug mount strings
+	j.LeaseId = redact(d.LeaseId)
+	if 0 < len(d.LeaseIds) {
+		j.LeaseIds = make([]string, len(d.LeaseIds))
+		for idx, leaseId := range d.LeaseIds {
+			j.LeaseIds[idx] = redact(leaseId)
+		}
+	}
+	return j
+}
+
+// MarshalJSON encodes the dysk with AccountKey and SASToken left out and
+// the lease ids redacted. Use MarshalJSONWithSecrets to include them
+func (d Dysk) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.toJSON(false))
+}
+
+// MarshalJSONWithSecrets encodes the dysk including AccountKey, SASToken
+// and the lease ids
+func (d *Dysk) MarshalJSONWithSecrets() ([]byte, error) {
+	return json.Marshal(d.toJSON(true))
+}
+
+// UnmarshalJSON decodes a dysk, the result can be passed to Mount
+func (d *Dysk) UnmarshalJSON(data []byte) error {
+	var j dyskJSON
+	if err := json.Unmarshal(data, &j); nil != err {
+		return err
+	}
+
+	*d = Dysk{
+		Type:         j.Type,
+		Name:         j.Name,
+		sectorCount:  j.SectorCount,
+		AccountName:  j.AccountName,
+		AccountKey:   j.AccountKey,
+		SASToken:     j.SASToken,
+		Path:         j.Path,
+		SnapshotTime: j.SnapshotTime,
+		host:         j.Host,
+		ip:           j.IP,
+		LeaseId:      j.LeaseId,
+		Major:        j.Major,
+		Minor:        j.Minor,
+		Vhd:          j.Vhd,
+		SizeGB:       j.SizeGB,
+		SizeBytes:    j.SizeBytes,
+		SectorSize:   j.SectorSize,
+		ReadAheadKB:  j.ReadAheadKB,
+		QueueDepth:   j.QueueDepth,
+		CacheMode:    j.CacheMode,
+		VhdType:      j.VhdType,
+		Paths:        j.Paths,
+		LeaseIds:     j.LeaseIds,
+		Layout:       j.Layout,
+	}
+	return nil
 }
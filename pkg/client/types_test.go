@@ -0,0 +1,49 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDyskJSONRedactsLeases(t *testing.T) {
+	d := testDysk("dysk01", 1)
+	d.Paths = []string{"/dysks/dysk01", "/dysks/dysk01b"}
+	d.LeaseIds = []string{"lease-dysk01", "lease-dysk01b"}
+
+	b, err := json.Marshal(d)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{d.AccountKey, "lease-dysk01", "lease-dysk01b"} {
+		if strings.Contains(string(b), secret) {
+			t.Fatalf("%q leaked into %s", secret, b)
+		}
+	}
+
+	var decoded Dysk
+	if err := json.Unmarshal(b, &decoded); nil != err {
+		t.Fatal(err)
+	}
+	if "<redacted>" != decoded.LeaseId || 2 != len(decoded.LeaseIds) || "<redacted>" != decoded.LeaseIds[1] {
+		t.Fatalf("expected redacted leases got %q %q", decoded.LeaseId, decoded.LeaseIds)
+	}
+
+	// unleased dysks still read as unleased
+	d.LeaseId = ""
+	d.LeaseIds = nil
+	if b, err = json.Marshal(d); nil != err {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"LeaseId":""`) {
+		t.Fatalf("expected an empty lease id in %s", b)
+	}
+
+	b, err = (&Dysk{LeaseId: "lease-dysk01", AccountKey: "a2V5"}).MarshalJSONWithSecrets()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "lease-dysk01") || !strings.Contains(string(b), "a2V5") {
+		t.Fatalf("expected secrets in %s", b)
+	}
+}
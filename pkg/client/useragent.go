@@ -0,0 +1,63 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// ClientVersion is reported in the User-Agent of the client's Azure calls
+const ClientVersion = "0.1.0"
+
+const defaultUserAgent = "dysk/" + ClientVersion
+
+// WithUserAgent tags the client's Azure calls with ua instead of
+// dysk/<ClientVersion>. It is appended to the SDK's own user agent unless
+// WithoutSDKTelemetry is set. Blob services passed to
+// CreateClientWithBlobService keep their user agent
+func WithUserAgent(ua string) ClientOption {
+	return func(c *dyskclient) {
+		if 0 < len(ua) {
+			c.userAgent = ua
+		}
+	}
+}
+
+// WithoutSDKTelemetry sends the client's user agent alone, without the SDK's
+// (Go version, OS and SDK version)
+func WithoutSDKTelemetry() ClientOption {
+	return func(c *dyskclient) {
+		c.sdkTelemetry = false
+	}
+}
+
+// overrides the User-Agent the SDK sets on every request
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tagged := req.Clone(req.Context())
+	tagged.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(tagged)
+}
+
+// tags storageClient's requests, httpClient is the one it is about to use
+// (nil for the SDK's default)
+func (c *dyskclient) setUserAgent(storageClient *storage.Client, httpClient *http.Client) (*http.Client, error) {
+	if c.sdkTelemetry {
+		return httpClient, storageClient.AddToUserAgent(c.userAgent)
+	}
+
+	tagged := &http.Client{}
+	if nil != httpClient {
+		*tagged = *httpClient
+	}
+	transport := tagged.Transport
+	if nil == transport {
+		transport = http.DefaultTransport
+	}
+	tagged.Transport = &userAgentTransport{userAgent: c.userAgent, base: transport}
+	return tagged, nil
+}
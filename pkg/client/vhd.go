@@ -0,0 +1,241 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/rubiojr/go-vhd/vhd"
+)
+
+// VhdType is the subtype of a vhd dysk
+type VhdType string
+
+const (
+	VhdFixed   VhdType = "fixed"   // footer only, the default
+	VhdDynamic VhdType = "dynamic" // sparse, data blocks are allocated through the BAT
+)
+
+const (
+	vhdDynamicHeaderSize = 1024
+	vhdBlockSize         = 2 * 1024 * 1024
+	vhdDiskTypeDynamic   = 3
+	vhdNoOffset          = 0xFFFFFFFFFFFFFFFF
+	vhdUnusedBlock       = 0xFFFFFFFF
+)
+
+// every vhd footer starts with this cookie
+var vhdCookie = []byte("conectix")
+
+// vhd timestamps count seconds from this
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// true if footer (the last 512 bytes of a blob) is a vhd footer
+func isVhdFooter(footer []byte) bool {
+	return bytes.HasPrefix(footer, vhdCookie)
+}
+
+// checks cookie and checksum of a vhd footer
+func isValidVhdFooter(footer []byte) error {
+	if vhd.VHD_HEADER_SIZE != len(footer) {
+		return fmt.Errorf("Footer is %d bytes, expected %d: %w", len(footer), vhd.VHD_HEADER_SIZE, ErrInvalidVhd)
+	}
+	if !isVhdFooter(footer) {
+		return fmt.Errorf("Footer cookie is %q, expected %q: %w", footer[:len(vhdCookie)], vhdCookie, ErrInvalidVhd)
+	}
+
+	stored := binary.BigEndian.Uint32(footer[64:])
+	withoutChecksum := make([]byte, vhd.VHD_HEADER_SIZE)
+	copy(withoutChecksum, footer)
+	copy(withoutChecksum[64:68], []byte{0, 0, 0, 0})
+	if computed := vhdChecksum(withoutChecksum); computed != stored {
+		return fmt.Errorf("Footer checksum %#x does not match computed %#x: %w", stored, computed, ErrInvalidVhd)
+	}
+	return nil
+}
+
+// Reads the last 512 bytes of pageBlob, its properties must be loaded.
+// opts picks the snapshot, if any
+func (c *dyskclient) readVhdFooter(ctx context.Context, pageBlob blobRef, opts *storage.GetBlobOptions) ([]byte, error) {
+	contentLength := pageBlob.Properties().ContentLength
+	if vhd.VHD_HEADER_SIZE > contentLength {
+		return nil, fmt.Errorf("Blob is %d bytes, too small for a footer: %w", contentLength, ErrInvalidVhd)
+	}
+
+	return c.readPageRange(ctx, pageBlob, uint64(contentLength-vhd.VHD_HEADER_SIZE), vhd.VHD_HEADER_SIZE, opts)
+}
+
+// Reads length bytes of pageBlob from start
+func (c *dyskclient) readPageRange(ctx context.Context, pageBlob blobRef, start uint64, length uint64, opts *storage.GetBlobOptions) ([]byte, error) {
+	getRange := storage.GetBlobRangeOptions{
+		GetBlobOptions: opts,
+		Range: &storage.BlobRange{
+			Start: start,
+			End:   start + length - 1,
+		},
+	}
+	var data []byte
+	err := c.doAzure(ctx, func() error {
+		r, err := pageBlob.GetRange(&getRange)
+		if nil != err {
+			return err
+		}
+		defer r.Close()
+		data, err = ioutil.ReadAll(r)
+		return err
+	})
+	return data, err
+}
+
+func isValidVhdType(vhdType VhdType) error {
+	switch vhdType {
+	case VhdFixed, VhdDynamic:
+		return nil
+	}
+	return fmt.Errorf("Invalid vhd type %q, must be %s or %s", vhdType, VhdFixed, VhdDynamic)
+}
+
+// vhd subtype recorded on the blob at creation, blobs that predate it are
+// fixed. sizeBytes is the virtual disk size of dynamic vhds
+func vhdTypeFromMetadata(pageBlob blobRef) (vhdType VhdType, sizeBytes uint64, err error) {
+	v, ok := pageBlob.Metadata()[vhdTypeMetadataKey]
+	if !ok || VhdFixed == VhdType(v) {
+		return VhdFixed, 0, nil
+	}
+	if VhdDynamic != VhdType(v) {
+		return "", 0, fmt.Errorf("Unknown vhd type %q in blob metadata", v)
+	}
+	sizeBytes, err = strconv.ParseUint(pageBlob.Metadata()[vhdSizeMetadataKey], 10, 64)
+	if nil != err {
+		return "", 0, fmt.Errorf("Invalid dynamic vhd size in blob metadata. Error:%s", err.Error())
+	}
+	return VhdDynamic, sizeBytes, nil
+}
+
+// Layout of a new dynamic vhd of virtual size sizeBytes. The page blob holds
+// footer copy - dynamic header - BAT - data blocks - footer. It is sized for
+// every block up front, page blobs only store the pages written so unallocated
+// blocks cost nothing
+type dynamicVhd struct {
+	sizeBytes uint64
+	entries   uint32
+	batBytes  uint64 // padded to a sector
+}
+
+func newDynamicVhd(sizeBytes uint64) *dynamicVhd {
+	entries := uint32((sizeBytes + vhdBlockSize - 1) / vhdBlockSize)
+	batBytes := (uint64(entries)*4 + vhd.VHD_HEADER_SIZE - 1) / vhd.VHD_HEADER_SIZE * vhd.VHD_HEADER_SIZE
+	return &dynamicVhd{sizeBytes: sizeBytes, entries: entries, batBytes: batBytes}
+}
+
+// size of the page blob holding the vhd with all blocks allocated. Each block
+// is preceded by a one sector bitmap
+func (v *dynamicVhd) blobSize() uint64 {
+	return v.headSize() + uint64(v.entries)*(vhd.VHD_HEADER_SIZE+vhdBlockSize) + vhd.VHD_HEADER_SIZE
+}
+
+func (v *dynamicVhd) headSize() uint64 {
+	return vhd.VHD_HEADER_SIZE + vhdDynamicHeaderSize + v.batBytes
+}
+
+// footer written in the last sector of the blob. Each call makes a new one
+// (unique id, timestamp), the copy in head must be the same footer
+func (v *dynamicVhd) footer() ([]byte, error) {
+	return vhdFooter(v.sizeBytes, vhdDiskTypeDynamic, vhd.VHD_HEADER_SIZE)
+}
+
+// footer copy, dynamic header and BAT, written at offset 0
+func (v *dynamicVhd) head(footer []byte) []byte {
+	b := new(bytes.Buffer)
+	b.Write(footer)
+	b.Write(v.dynamicHeader())
+	bat := make([]byte, v.batBytes)
+	for idx := uint32(0); idx < v.entries; idx++ {
+		binary.BigEndian.PutUint32(bat[idx*4:], vhdUnusedBlock)
+	}
+	b.Write(bat)
+	return b.Bytes()
+}
+
+func (v *dynamicVhd) dynamicHeader() []byte {
+	h := make([]byte, vhdDynamicHeaderSize)
+	copy(h[0:], "cxsparse")
+	binary.BigEndian.PutUint64(h[8:], vhdNoOffset)
+	binary.BigEndian.PutUint64(h[16:], vhd.VHD_HEADER_SIZE+vhdDynamicHeaderSize) // BAT
+	binary.BigEndian.PutUint32(h[24:], 0x00010000)
+	binary.BigEndian.PutUint32(h[28:], v.entries)
+	binary.BigEndian.PutUint32(h[32:], vhdBlockSize)
+	binary.BigEndian.PutUint32(h[36:], vhdChecksum(h))
+	return h
+}
+
+// 512 byte hard disk footer, see the VHD format specification
+func vhdFooter(sizeBytes uint64, diskType uint32, dataOffset uint64) ([]byte, error) {
+	f := make([]byte, vhd.VHD_HEADER_SIZE)
+	copy(f[0:], vhdCookie)
+	binary.BigEndian.PutUint32(f[8:], 0x00000002) // features, reserved bit
+	binary.BigEndian.PutUint32(f[12:], 0x00010000)
+	binary.BigEndian.PutUint64(f[16:], dataOffset)
+	binary.BigEndian.PutUint32(f[24:], uint32(time.Since(vhdEpoch)/time.Second))
+	copy(f[28:], "dysk")
+	binary.BigEndian.PutUint32(f[32:], 0x00010000)
+	copy(f[36:], "Wi2k")
+	binary.BigEndian.PutUint64(f[40:], sizeBytes)
+	binary.BigEndian.PutUint64(f[48:], sizeBytes)
+	binary.BigEndian.PutUint32(f[56:], vhdGeometry(sizeBytes))
+	binary.BigEndian.PutUint32(f[60:], diskType)
+	if _, err := rand.Read(f[68:84]); nil != err {
+		return nil, fmt.Errorf("Failed to generate vhd unique id. Error:%s", err.Error())
+	}
+	binary.BigEndian.PutUint32(f[64:], vhdChecksum(f))
+	return f, nil
+}
+
+// one's complement of the sum of all bytes, the checksum field is zero
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, v := range b {
+		sum += uint32(v)
+	}
+	return ^sum
+}
+
+// cylinders-heads-sectors per the VHD specification
+func vhdGeometry(sizeBytes uint64) uint32 {
+	totalSectors := sizeBytes / 512
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	var sectorsPerTrack, heads, cylinderTimesHeads uint64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	cylinders := cylinderTimesHeads / heads
+	return uint32(cylinders)<<16 | uint32(heads)<<8 | uint32(sectorsPerTrack)
+}